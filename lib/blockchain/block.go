@@ -2,34 +2,96 @@ package blockchain
 
 import (
 	"bytes"
-	"encoding/gob"
-	"log"
-	"time"
+	"context"
+	"crypto/sha256"
+	"fmt"
 )
 
-type Block struct {
-	TimeStamp						int64
-	Hash							[]byte
-	Transactions					[]*Transaction
+const (
+	BlockVersion = 1
+)
+
+type BlockHeader struct {
+	Version							int
 	PrevHash						[]byte
+	MerkleRoot						[]byte
+	TimeStamp						int64
+	Bits							uint32
 	Nonce							int
 	Height							int
+	// public key and signature of the authority that sealed the block, empty
+	// under proof of work
+	Signer							[]byte
+	Signature						[]byte
 }
 
-func CreateBlock(txs []*Transaction, prevHash []byte, height int) *Block {
-	block := &Block{time.Now().Unix(), []byte{}, txs, prevHash, 0, height}
-	pow := NewProof(block)
-	nonce, hash := pow.Run()
+type Block struct {
+	BlockHeader
+	Hash							[]byte
+	Transactions					[]*Transaction
+}
 
-	block.Hash = hash
+// NewBlock seals a block with engine on top of prevHash, it gives up with
+// ctx.Err() when ctx is cancelled.
+func NewBlock(ctx context.Context, engine Engine, chain ChainReader, txs []*Transaction, prevHash []byte, height int, timestamp int64) (*Block, error) {
+	header := BlockHeader{Version: BlockVersion, PrevHash: prevHash, TimeStamp: timestamp, Height: height}
+	if err := engine.Prepare(chain, &header); err != nil {
+		return nil, err
+	}
 
-	block.Nonce = nonce
+	block := &Block{header, []byte{}, txs}
+	block.MerkleRoot = block.HashTransactions()
 
-	return block
+	if err := engine.Seal(ctx, &block.BlockHeader); err != nil {
+		return nil, err
+	}
+	block.Hash = block.BlockHeader.Hash()
+
+	return block, nil
+}
+
+
+func Genesis(engine Engine, coinbase *Transaction) (*Block, error) {
+	return NewBlock(context.Background(), engine, nil, []*Transaction{coinbase}, []byte{}, 0, SystemClock.Now().Unix())
 }
 
-func Genesis(coinbase *Transaction) *Block{
-	return CreateBlock([]*Transaction{coinbase}, []byte{}, 0)
+
+// Bytes is the data the block hash commits to.
+func (header *BlockHeader) Bytes() []byte {
+	return EncodeHeader(header)
+}
+
+
+func (header *BlockHeader) Hash() []byte {
+	hash := sha256.Sum256(header.Bytes())
+
+	return hash[:]
+}
+
+
+// SealHash is what an authority signs: the header without its signature.
+func (header *BlockHeader) SealHash() []byte {
+	unsigned := *header
+	unsigned.Signature = nil
+
+	return unsigned.Hash()
+}
+
+
+func (header *BlockHeader) Serialize() []byte {
+	return EncodeHeader(header)
+}
+
+
+func DeserializeHeader(data []byte) (*BlockHeader, error) {
+	header, err := DecodeHeader(data)
+	if err != nil {
+		if decodeLegacy(data, &header) != nil {
+			return nil, err
+		}
+	}
+
+	return &header, nil
 }
 
 
@@ -46,31 +108,33 @@ func (block *Block) HashTransactions() []byte{
 }
 
 
-func (block *Block) Serialize() []byte{
-	var res bytes.Buffer
-	encoder := gob.NewEncoder(&res)
-
-	err := encoder.Encode(block)
-
-	HandleError(err)
+// MerkleProof proves that the transaction txID is part of the block.
+func (block *Block) MerkleProof(txID []byte) (*MerkleProof, error) {
+	for index, tx := range block.Transactions {
+		if bytes.Equal(tx.ID, txID) {
+			proof := NewMerkleProof(block.Transactions, index)
+			proof.BlockHash = block.Hash
+			return proof, nil
+		}
+	}
 
-	return res.Bytes()
+	return nil, fmt.Errorf("transaction %x in block %x: %w", txID, block.Hash, ErrNotFound)
 }
 
-func Deserialize(data []byte) *Block{
-	var block Block
-
-	decoder := gob.NewDecoder(bytes.NewReader(data))
 
-	err := decoder.Decode(&block)
-
-	HandleError(err)
-
-	return &block
+func (block *Block) Serialize() []byte{
+	return EncodeBlock(block)
 }
 
-func HandleError(err error) {
+// Deserialize reads a block from the database, where blocks stored before
+// the encoding existed are gob. Blocks from peers go through DecodeBlock.
+func Deserialize(data []byte) (*Block, error) {
+	block, err := DecodeBlock(data)
 	if err != nil {
-		log.Panic(err)
+		if decodeLegacy(data, &block) != nil {
+			return nil, err
+		}
 	}
-}
\ No newline at end of file
+
+	return &block, nil
+}
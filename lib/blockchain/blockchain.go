@@ -2,17 +2,14 @@ package blockchain
 
 import (
 	"bytes"
+	"context"
 	"crypto/ecdsa"
 	"encoding/hex"
 	"errors"
 	"fmt"
-	"log"
-	"os"
-	"path/filepath"
-	"runtime"
-	"strings"
-
-	"github.com/dgraph-io/badger"
+	"math/big"
+	"sync"
+	"tensor/lib/storage"
 )
 
 const (
@@ -22,259 +19,613 @@ const (
 	dbPath = "./DB/blocks_%s"
 )
 
+var (
+	workprefix = []byte("work-")
+	headerprefix = []byte("header-")
+)
+
 type BlockChain struct {
+	// read through Tip once the chain is shared between goroutines
 	LastHash					[]byte
-	Database					*badger.DB
+	Database					storage.Store
+	Params						*ChainParams
+	Engine						Engine
+	Clock						Clock
+	TxIndex						bool
+	AddrIndex					bool
+	// blocks kept below the tip, 0 keeps every block
+	PruneDepth					int
+	// Light chains keep headers and proven transactions only
+	Light						bool
+	closed						bool
+	// headers fetched towards the last checkpoint that do not reach it yet,
+	// hold mutex
+	checkpointHeaders			[]*BlockHeader
+	// mutex serializes changes to the chain, tipMutex guards LastHash
+	mutex						sync.Mutex
+	tipMutex					sync.RWMutex
+}
+
+
+func InitBlockChain(address, nodeID string, engine Engine) (*BlockChain, error) {
+	return initBlockChain(nodeID, func(store storage.Store) (*BlockChain, error) {
+		return CreateBlockChain(store, engine, address)
+	})
+}
+
+
+// InitBlockChainFromGenesis starts the chain of nodeID from a genesis block
+// made elsewhere, such as the first block of a bootstrap file.
+func InitBlockChainFromGenesis(nodeID string, engine Engine, genesis *Block) (*BlockChain, error) {
+	return initBlockChain(nodeID, func(store storage.Store) (*BlockChain, error) {
+		return CreateBlockChainFromGenesis(store, engine, genesis)
+	})
 }
 
 
-func DBexists(path string) bool {
-	if _, err := os.Stat(path+"/MANIFEST"); os.IsNotExist(err){
-		return false
+func initBlockChain(nodeID string, create func(store storage.Store) (*BlockChain, error)) (*BlockChain, error) {
+	path := fmt.Sprintf(dbPath, nodeID)
+
+	if storage.Exists(path) {
+		return nil, ErrChainExists
+	}
+
+	store, err := storage.OpenBadger(path)
+	if err != nil {
+		return nil, fmt.Errorf("opening database: %w", err)
+	}
+
+	chain, err := create(store)
+	if err != nil {
+		store.Close()
+		return nil, err
 	}
-	return true
+
+	return chain, nil
 }
 
 
-func InitBlockChain(address, nodeID string) *BlockChain{
+func ContinueBlockChain(nodeID string, engine Engine) (*BlockChain, error) {
 	path := fmt.Sprintf(dbPath, nodeID)
-	var lastHash []byte
 
-	if DBexists(path) {
-		fmt.Println("Blockchain already exists")
-		runtime.Goexit()
+	if !storage.Exists(path) {
+		return nil, ErrNoChain
+	}
+
+	store, err := storage.OpenBadger(path)
+	if err != nil {
+		return nil, fmt.Errorf("opening database: %w", err)
 	}
 
+	chain, err := LoadBlockChain(store, engine)
+	if err != nil {
+		store.Close()
+		return nil, err
+	}
 
-	opts := badger.DefaultOptions(path)
-	opts.Dir = path
-	opts.ValueDir = path
+	return chain, nil
+}
 
-	db, err := OpenDB(path, opts)
-	HandleError(err)
 
-	err = db.Update(func(txn *badger.Txn) error{
-			cbtx := CoinbaseTx(address, GenesisData)
-			genesis := Genesis(cbtx)
-			fmt.Println("genesis Proved")
-			err := txn.Set(genesis.Hash, genesis.Serialize())
-			HandleError(err)
-			err = txn.Set([]byte("lh"), genesis.Hash)
-			HandleError(err)
-			lastHash = genesis.Hash
-			return err
+// CreateBlockChain starts a new chain in store sealed by engine, the genesis
+// block pays its reward to address.
+func CreateBlockChain(store storage.Store, engine Engine, address string) (*BlockChain, error) {
+	if err := checkEmpty(store); err != nil {
+		return nil, err
+	}
+
+	cbtx, err := CoinbaseTx(address, GenesisData, DefaultParams.BlockSubsidy(0))
+	if err != nil {
+		return nil, err
+	}
+	genesis, err := Genesis(engine, cbtx)
+	if err != nil {
+		return nil, err
+	}
+	fmt.Println("genesis Proved")
+
+	return storeGenesis(store, engine, genesis)
+}
+
+
+// CreateBlockChainFromGenesis starts a new chain in store from a genesis
+// block that was sealed elsewhere, it is validated first.
+func CreateBlockChainFromGenesis(store storage.Store, engine Engine, genesis *Block) (*BlockChain, error) {
+	if err := checkEmpty(store); err != nil {
+		return nil, err
+	}
+
+	chain := BlockChain{Database: store, Params: &DefaultParams, Engine: engine, Clock: SystemClock}
+	if err := chain.validateGenesis(genesis); err != nil {
+		return nil, err
+	}
+
+	return storeGenesis(store, engine, genesis)
+}
+
+
+func checkEmpty(store storage.Store) error {
+	err := store.View(func(txn storage.Txn) error {
+		_, err := txn.Get([]byte("lh"))
+		return err
 	})
+	if err == nil {
+		return ErrChainExists
+	}
+	if !errors.Is(err, storage.ErrNotFound) {
+		return dbError(err)
+	}
 
-	HandleError(err)
+	return nil
+}
 
-	blockchain := BlockChain{LastHash: lastHash, Database: db}
 
-	return &blockchain
+func storeGenesis(store storage.Store, engine Engine, genesis *Block) (*BlockChain, error) {
+	err := store.Update(func(txn storage.Txn) error{
+			if err := storeBlock(txn, genesis, engine.Weight(&genesis.BlockHeader)); err != nil {
+				return err
+			}
+			if err := txn.Put(heightKey(0), genesis.Hash); err != nil {
+				return err
+			}
+			// the genesis is connected like any other block, its coinbase
+			// is spendable and it has undo data
+			if _, err := updateCoins(txn, genesis); err != nil {
+				return err
+			}
+			return txn.Put([]byte("lh"), genesis.Hash)
+	})
+	if err != nil {
+		return nil, fmt.Errorf("storing genesis block: %w", dbError(err))
+	}
+
+	blockchain := BlockChain{LastHash: genesis.Hash, Database: store, Params: &DefaultParams, Engine: engine, Clock: SystemClock}
+
+	return &blockchain, nil
 }
 
 
-func ContinueBlockChain(nodeID string) *BlockChain{
-	path := fmt.Sprintf(dbPath, nodeID)
+// LoadBlockChain opens the chain kept in store, sealed by engine.
+func LoadBlockChain(store storage.Store, engine Engine) (*BlockChain, error) {
 	var lastHash []byte
-	
-	if !DBexists(path){
-		fmt.Println("No existing blockchain found. Create one!")
-		runtime.Goexit()
-	}
-	
-	
-	opts := badger.DefaultOptions(path)
-	opts.Dir = path
-	opts.ValueDir = path
-	
-	db, err := OpenDB(path, opts)
-	HandleError(err)
-
-	err = db.Update(func(txn *badger.Txn) error{
-			item, err := txn.Get([]byte("lh"))
-			HandleError(err)
-			lastHash, err = item.ValueCopy([]byte("lh"))
-			return err
+	var txIndex, addrIndex bool
+	var prune int
+
+	err := store.View(func(txn storage.Txn) error{
+			var err error
+			if _, err = txn.Get(lightKey); err == nil {
+				return fmt.Errorf("store holds a light chain")
+			}
+			if lastHash, err = txn.Get([]byte("lh")); err != nil {
+				return err
+			}
+			txIndex = txIndexEnabled(txn)
+			addrIndex = addrIndexEnabled(txn)
+			prune = pruneDepth(txn)
+			return nil
 	})
+	if errors.Is(err, storage.ErrNotFound) {
+		return nil, ErrNoChain
+	}
+	if err != nil {
+		return nil, fmt.Errorf("reading last hash: %w", dbError(err))
+	}
 
-	HandleError(err)
+	blockchain := BlockChain{LastHash: lastHash, Database: store, Params: &DefaultParams, Engine: engine, Clock: SystemClock, TxIndex: txIndex, AddrIndex: addrIndex, PruneDepth: prune}
 
-	blockchain := BlockChain{LastHash: lastHash, Database: db}
+	indexed, err := blockchain.heightIndexed()
+	if err == nil && !indexed {
+		err = blockchain.ReindexHeights()
+	}
+	if err == nil {
+		_, err = UTXOSet{&blockchain}.MigrateLegacy()
+	}
+	if err != nil {
+		return nil, err
+	}
 
-	return &blockchain
+	return &blockchain, nil
 }
 
 
 
-func (chain *BlockChain)AddBlock(block *Block) {
-	err := chain.Database.Update(func(txn *badger.Txn) error {
-		if _, err := txn.Get(block.Hash); err ==  nil {
-			return nil
-		}
+// Tip returns the hash of the last block of the active chain.
+func (chain *BlockChain) Tip() []byte {
+	chain.tipMutex.RLock()
+	defer chain.tipMutex.RUnlock()
+
+	return chain.LastHash
+}
+
+
+func (chain *BlockChain) setTip(hash []byte) {
+	chain.tipMutex.Lock()
+	chain.LastHash = hash
+	chain.tipMutex.Unlock()
+}
+
+
+// AddBlock stores block and makes it the tip when its branch has the most
+// work. Blocks are added one at a time, it is safe to call from several
+// goroutines.
+func (chain *BlockChain) AddBlock(block *Block) error {
+	var bestChain bool
+
+	chain.mutex.Lock()
+	defer chain.mutex.Unlock()
 
-		blockData := block.Serialize()
-		err := txn.Set(block.Hash, blockData)
-		HandleError(err)
+	if chain.Light {
+		return fmt.Errorf("block %x: a light chain keeps headers only", block.Hash)
+	}
 
-		item, err := txn.Get([]byte("lh"))
-		HandleError(err)
-		lastHash, _ := item.ValueCopy(nil)
+	if _, err := chain.GetBlockHeader(block.Hash); err == nil {
+		return nil
+	}
+
+	if err := chain.ValidateBlock(block); err != nil {
+		return err
+	}
 
-		item, err = txn.Get(lastHash)
-		HandleError(err)
-		lastBlockData, _ := item.ValueCopy(nil)
+	err := chain.update(func(txn storage.Txn) error {
+		parentWork, err := chain.chainWork(txn, block.PrevHash)
+		if err != nil {
+			return err
+		}
 
-		lastBlock := Deserialize(lastBlockData)
+		work := new(big.Int).Add(parentWork, chain.Engine.Weight(&block.BlockHeader))
 
-		if block.Height > lastBlock.Height {
-			err := txn.Set([]byte("lh"), block.Hash)
-			HandleError(err)
-			chain.LastHash = block.Hash
+		if err := storeBlock(txn, block, work); err != nil {
+			return err
 		}
 
+		lastHash, err := txn.Get([]byte("lh"))
+		if err != nil {
+			return err
+		}
+
+		bestWork, err := chain.chainWork(txn, lastHash)
+		if err != nil {
+			return err
+		}
+
+		bestChain = work.Cmp(bestWork) > 0
+
 		return nil
 	})
-	HandleError(err)
+	if err != nil {
+		return fmt.Errorf("storing block %x: %w", block.Hash, err)
+	}
+
+	if bestChain {
+		return chain.reorganize(block)
+	}
+
+	return nil
 }
 
 
-func (chain *BlockChain) GetBlock(blockHash []byte) (Block, error) {
-	var block Block
+func (chain *BlockChain) reorganize(newTip *Block) error {
+	detach, attach, err := chain.findFork(newTip)
+	if err != nil {
+		return err
+	}
 
-	err := chain.Database.View(func(txn *badger.Txn) error {
-		if item, err := txn.Get(blockHash); err != nil {
-			return errors.New("Block is not Found")
-		}else {
-			blockData, _ := item.ValueCopy(nil)
+	if len(detach) > 0 {
+		fmt.Printf("Reorganizing: disconnecting %d blocks, connecting %d blocks\n", len(detach), len(attach))
+	}
 
-			block = *Deserialize(blockData)
+	// one transaction, a failure half way leaves the old branch in place
+	err = chain.update(func(txn storage.Txn) error {
+		for _, block := range detach {
+			if err := chain.disconnectBlock(txn, block); err != nil {
+				return fmt.Errorf("disconnecting block %x: %w", block.Hash, err)
+			}
 		}
-		
+
+		for _, block := range attach {
+			if err := chain.connectBlock(txn, block); err != nil {
+				return fmt.Errorf("connecting block %x: %w", block.Hash, err)
+			}
+		}
+
 		return nil
 	})
+	if err != nil {
+		return err
+	}
+
+	chain.setTip(newTip.Hash)
+
+	if _, err := chain.prune(); err != nil {
+		return err
+	}
 
+	return nil
+}
+
+
+// findFork returns the blocks of the active chain above the common ancestor
+// (tip first) and the blocks of the new branch above it (ancestor first).
+func (chain *BlockChain) findFork(newTip *Block) ([]*Block, []*Block, error) {
+	var detach, attach []*Block
+
+	oldBlock, err := chain.getBlock(chain.Tip())
 	if err != nil {
-		return block, err
+		return nil, nil, err
+	}
+	newBlock := newTip
+
+	for oldBlock.Height > newBlock.Height {
+		detach = append(detach, oldBlock)
+		if oldBlock, err = chain.getBlock(oldBlock.PrevHash); err != nil {
+			return nil, nil, err
+		}
+	}
+
+	for newBlock.Height > oldBlock.Height {
+		attach = append(attach, newBlock)
+		if newBlock, err = chain.getBlock(newBlock.PrevHash); err != nil {
+			return nil, nil, err
+		}
+	}
+
+	for !bytes.Equal(oldBlock.Hash, newBlock.Hash) {
+		detach = append(detach, oldBlock)
+		attach = append(attach, newBlock)
+		if oldBlock, err = chain.getBlock(oldBlock.PrevHash); err != nil {
+			return nil, nil, err
+		}
+		if newBlock, err = chain.getBlock(newBlock.PrevHash); err != nil {
+			return nil, nil, err
+		}
 	}
 
-	return block, err
+	for i, j := 0, len(attach)-1; i < j; i, j = i+1, j-1 {
+		attach[i], attach[j] = attach[j], attach[i]
+	}
+
+	return detach, attach, nil
 }
 
 
-func (chain *BlockChain) GetBlockHashes() [][]byte {
-	var blocks [][]byte
+func (chain *BlockChain) getBlock(hash []byte) (*Block, error) {
+	block, err := chain.GetBlock(hash)
 
-	iter := chain.Iterator()
+	return &block, err
+}
+
+
+func workKey(hash []byte) []byte {
+	return append(append([]byte{}, workprefix...), hash...)
+}
+
+
+func headerKey(hash []byte) []byte {
+	return append(append([]byte{}, headerprefix...), hash...)
+}
+
+
+func storeBlock(txn storage.Txn, block *Block, work *big.Int) error {
+	if err := txn.Put(block.Hash, block.Serialize()); err != nil {
+		return err
+	}
+
+	if err := txn.Put(headerKey(block.Hash), block.BlockHeader.Serialize()); err != nil {
+		return err
+	}
+
+	return txn.Put(workKey(block.Hash), work.Bytes())
+}
+
+
+// getHeader reads a stored header. Blocks stored before headers were kept
+// separately have their header taken from the full block.
+func getHeader(txn storage.Txn, hash []byte) (*BlockHeader, error) {
+	if headerData, err := txn.Get(headerKey(hash)); err == nil {
+		return DeserializeHeader(headerData)
+	}
+
+	blockData, err := txn.Get(hash)
+	if err != nil {
+		return nil, err
+	}
+
+	block, err := Deserialize(blockData)
+	if err != nil {
+		return nil, err
+	}
+
+	return &block.BlockHeader, nil
+}
+
+
+// chainWork returns the total work of the chain ending at hash. Blocks stored
+// before work was tracked get their work recomputed from their ancestors.
+func (chain *BlockChain) chainWork(txn storage.Txn, hash []byte) (*big.Int, error) {
+	var missing []*BlockHeader
+
+	work := new(big.Int)
 
 	for {
-		block := iter.Next()
-		blocks = append(blocks, block.Hash)
+		if value, err := txn.Get(workKey(hash)); err == nil {
+			work.SetBytes(value)
+			break
+		}
 
-		if len(block.PrevHash) == 0 {
+		header, err := getHeader(txn, hash)
+		if err != nil {
+			return nil, err
+		}
+		missing = append(missing, header)
+
+		if len(header.PrevHash) == 0 {
 			break
 		}
+		hash = header.PrevHash
 	}
 
-	return blocks
+	for _, header := range missing {
+		work.Add(work, chain.Engine.Weight(header))
+	}
+
+	return work, nil
 }
 
 
-func (chain *BlockChain) GetBestHeight() int {
-	var lastBlock Block
+func (chain *BlockChain) GetBlock(blockHash []byte) (Block, error) {
+	var block Block
 
-	err := chain.Database.View(func(txn *badger.Txn) error {
-		item, err := txn.Get([]byte("lh"))
-		HandleError(err)
+	err := chain.view(func(txn storage.Txn) error {
+		blockData, err := chain.getBlockData(txn, blockHash)
+		if err != nil {
+			return err
+		}
 
-		lastHash, _ := item.ValueCopy(nil)
-		item, err = txn.Get(lastHash)
-		HandleError(err)
-		lastBlockData, _ := item.ValueCopy(nil)
-		lastBlock = *Deserialize(lastBlockData)
+		stored, err := Deserialize(blockData)
+		if err != nil {
+			return err
+		}
+		block = *stored
 
 		return nil
 	})
-	HandleError(err)
+	if err != nil {
+		return block, fmt.Errorf("block %x: %w", blockHash, err)
+	}
 
-	return lastBlock.Height
+	return block, nil
 }
 
 
+func (chain *BlockChain) GetBlockHeader(blockHash []byte) (BlockHeader, error) {
+	var header BlockHeader
 
-func (chain *BlockChain) MineBlock(transactions []*Transaction) *Block {
-	var lastHash []byte
-	var lastHeight int
+	err := chain.view(func(txn storage.Txn) error {
+		stored, err := getHeader(txn, blockHash)
+		if err != nil {
+			return err
+		}
+		header = *stored
+
+		return nil
+	})
+	if err != nil {
+		return header, fmt.Errorf("block header %x: %w", blockHash, err)
+	}
 
+	return header, nil
+}
 
-	for _, tx := range transactions {
-		if !chain.VerifyTransaction(tx) {
-			log.Panic("invalid Transaction")
+
+// GetBlockHashes lists the active chain from the tip down to the block at
+// minHeight.
+func (chain *BlockChain) GetBlockHashes(minHeight int) ([][]byte, error) {
+	var blocks [][]byte
+
+	hash := chain.Tip()
+
+	for {
+		header, err := chain.GetBlockHeader(hash)
+		if err != nil {
+			return nil, err
 		}
-	}
+		if header.Height < minHeight {
+			break
+		}
+		blocks = append(blocks, hash)
 
+		if len(header.PrevHash) == 0 {
+			break
+		}
+		hash = header.PrevHash
+	}
 
-	err := chain.Database.View(func(txn *badger.Txn) error{
-		item, err := txn.Get([]byte("lh"))
-		HandleError(err)
-		lastHash, err = item.ValueCopy([]byte("lh"))
-		return err
+	return blocks, nil
+}
 
-		item, err = txn.Get(lastHash)
-		HandleError(err)
 
-		lastBlockData, err := item.ValueCopy(nil)
-		lastBlock := Deserialize(lastBlockData)
+func (chain *BlockChain) GetBestHeight() (int, error) {
+	var lastHeader *BlockHeader
 
-		lastHeight = lastBlock.Height
+	err := chain.view(func(txn storage.Txn) error {
+		lastHash, err := txn.Get([]byte("lh"))
+		if err != nil {
+			return err
+		}
 
+		lastHeader, err = getHeader(txn, lastHash)
 		return err
 	})
-	HandleError(err)
+	if err != nil {
+		return 0, fmt.Errorf("reading best height: %w", err)
+	}
 
-	newBlock := CreateBlock(transactions, lastHash, lastHeight+1)
+	return lastHeader.Height, nil
+}
 
-	err = chain.Database.Update(func(txn *badger.Txn) error{
-		err := txn.Set(newBlock.Hash, newBlock.Serialize())
-		HandleError(err)
-		err = txn.Set([]byte("lh"), newBlock.Hash)
-		chain.LastHash = newBlock.Hash
-		return err
-	})
-	HandleError(err)
 
-	return newBlock
+
+// MineBlock seals transactions on top of the current tip and adds the block.
+// Cancelling ctx stops the search and returns ctx.Err().
+func (chain *BlockChain) MineBlock(ctx context.Context, transactions []*Transaction) (*Block, error) {
+	budget := NewBlockBudget(chain.Params)
+
+	for _, tx := range transactions {
+		if err := chain.VerifyTransaction(tx); err != nil {
+			return nil, err
+		}
+		if err := budget.Add(tx); err != nil {
+			return nil, fmt.Errorf("transaction %x: %w", tx.ID, err)
+		}
+	}
+
+	lastBlock, err := chain.getBlock(chain.Tip())
+	if err != nil {
+		return nil, err
+	}
+
+	timestamp, err := chain.nextTimestamp(&lastBlock.BlockHeader)
+	if err != nil {
+		return nil, err
+	}
+
+	newBlock, err := NewBlock(ctx, chain.Engine, chain, transactions, lastBlock.Hash, lastBlock.Height+1, timestamp)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := chain.AddBlock(newBlock); err != nil {
+		return nil, err
+	}
+
+	return newBlock, nil
 }
 
 
-func (chain *BlockChain) FindUTXO() map[string]TxOutputs {
-	UTXO := make(map[string]TxOutputs)
-	spentTxos := make(map[string][]int)
+func (chain *BlockChain) FindUTXO() (map[Outpoint]UTXO, error) {
+	utxos := make(map[Outpoint]UTXO)
+	spentTxos := make(map[Outpoint]bool)
 
 	iter := chain.Iterator()
 
 	for {
-		block := iter.Next()
+		block, err := iter.Next()
+		if err != nil {
+			return nil, err
+		}
 
 		for _, tx := range block.Transactions {
 			txID := hex.EncodeToString(tx.ID)
 
-			outputs:
 			for index, out := range tx.Outputs{
-				if spentTxos[txID] != nil {
-					for _, spentOut := range spentTxos[txID] {
-						if spentOut == index {
-							continue outputs
-						}
-					}
+				outpoint := Outpoint{txID, index}
+				if !spentTxos[outpoint] {
+					utxos[outpoint] = UTXO{out, block.Height, tx.IsCoinbase()}
 				}
-				outs := UTXO[txID]
-				outs.Outputs = append(outs.Outputs, out)
-				UTXO[txID] = outs
 			}
 			if  !tx.IsCoinbase(){
 				for _, input := range tx.Inputs{
-					inputTxID := hex.EncodeToString(input.ID)
-					spentTxos[inputTxID] = append(spentTxos[inputTxID], input.Out)
+					spentTxos[Outpoint{hex.EncodeToString(input.ID), input.Out}] = true
 				}
 			}
 		}
@@ -285,21 +636,40 @@ func (chain *BlockChain) FindUTXO() map[string]TxOutputs {
 
 	}
 
-	return UTXO
+	return utxos, nil
 }
 
 
 
 
 func (bc *BlockChain) FindTransaction(ID []byte) (Transaction, error) {
+	tx, _, err := bc.findTransactionHeight(ID)
+
+	return tx, err
+}
+
+
+// findTransactionHeight also returns the height of the block that included
+// the transaction.
+func (bc *BlockChain) findTransactionHeight(ID []byte) (Transaction, int, error) {
+	if bc.TxIndex {
+		return bc.findIndexedTransaction(ID)
+	}
+
 	iter := bc.Iterator()
 
 	for {
-		block := iter.Next()
+		block, err := iter.Next()
+		if errors.Is(err, ErrBlockPruned) {
+			return bc.unspentTransaction(ID)
+		}
+		if err != nil {
+			return Transaction{}, 0, err
+		}
 
 		for _, tx := range block.Transactions {
 			if bytes.Compare(tx.ID, ID) == 0 {
-				return *tx, nil
+				return *tx, block.Height, nil
 			}
 		}
 
@@ -308,68 +678,133 @@ func (bc *BlockChain) FindTransaction(ID []byte) (Transaction, error) {
 		}
 	}
 
-	return  Transaction{}, errors.New("Transaction does not exist")
+	return  Transaction{}, 0, fmt.Errorf("transaction %x: %w", ID, ErrNotFound)
 }
 
 
-func (bc *BlockChain) SignTransaction(tx *Transaction, privKey ecdsa.PrivateKey) {
+// GetTxProof proves that the transaction ID is part of the active chain.
+func (bc *BlockChain) GetTxProof(ID []byte) (*MerkleProof, error) {
+	_, height, err := bc.findTransactionHeight(ID)
+	if err != nil {
+		return nil, err
+	}
+
+	block, err := bc.GetBlockByHeight(height)
+	if err != nil {
+		return nil, err
+	}
+
+	return block.MerkleProof(ID)
+}
+
+
+func (bc *BlockChain) findInputs(tx *Transaction) (map[string]Transaction, error) {
 	prevTxs := make(map[string]Transaction)
 
 	for _, input := range tx.Inputs {
 		prevTX, err := bc.FindTransaction(input.ID)
-		HandleError(err)
+		if err != nil {
+			return nil, err
+		}
 		prevTxs[hex.EncodeToString(prevTX.ID)] = prevTX
 	}
 
-	tx.Sign(privKey, prevTxs)
+	return prevTxs, nil
 }
 
 
-func (bc *BlockChain) VerifyTransaction(tx *Transaction) bool {
+func (bc *BlockChain) TransactionFee(tx *Transaction) (int, error) {
 	if tx.IsCoinbase() {
-		return true
+		return 0, nil
 	}
-	
-	prevTxs := make(map[string]Transaction)
 
+	prevTxs, err := bc.findInputs(tx)
+	if err != nil {
+		return 0, err
+	}
 
-	for _, input := range tx.Inputs {
-		prevTX, err := bc.FindTransaction(input.ID)
-		HandleError(err)
-		prevTxs[hex.EncodeToString(prevTX.ID)] = prevTX
+	return tx.Fee(prevTxs), nil
+}
+
+
+func (bc *BlockChain) SignTransaction(tx *Transaction, privKey ecdsa.PrivateKey) error {
+	prevTxs, err := bc.findInputs(tx)
+	if err != nil {
+		return err
 	}
 
-	return tx.Verify(prevTxs)
+	return tx.Sign(privKey, prevTxs)
 }
 
 
+// isUnspent reports whether output out of transaction txID is in the UTXO set.
+func (bc *BlockChain) isUnspent(txID []byte, out int) (bool, error) {
+	err := bc.view(func(txn storage.Txn) error {
+		_, err := txn.Get(utxoKey(txID, out))
+		return err
+	})
+	if errors.Is(err, ErrNotFound) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+
+	return true, nil
+}
 
 
-func Retry(dir string, originalOpts badger.Options) (*badger.DB, error) {
-	lockPath := filepath.Join(dir, "LOCK")
-	if err := os.Remove(lockPath); err != nil {
-		return nil, fmt.Errorf(`Removing "Lock" %s`, err)
+// VerifyTransaction checks a transaction against the active chain. The error
+// wraps ErrInvalidTransaction when the transaction could not be mined.
+func (bc *BlockChain) VerifyTransaction(tx *Transaction) error {
+	if tx.IsCoinbase() {
+		return nil
 	}
 
-	retryOpts := originalOpts
-	retryOpts.Truncate = true
-	db, err := badger.Open(retryOpts)
+	prevTxs := make(map[string]Transaction)
+	spent := make(map[string]bool)
+	bestHeight, err := bc.GetBestHeight()
+	if err != nil {
+		return err
+	}
 
-	return db, err
-}
 
+	for _, input := range tx.Inputs {
+		outpoint := fmt.Sprintf("%x:%d", input.ID, input.Out)
+		if spent[outpoint] {
+			return fmt.Errorf("transaction %x spends %s twice: %w", tx.ID, outpoint, ErrInvalidTransaction)
+		}
+		spent[outpoint] = true
 
-func OpenDB(dir string, opts badger.Options) (*badger.DB, error) {
-	if db, err := badger.Open(opts); err != nil {
-		if strings.Contains(err.Error(), "LOCK") {
-			if db, err := Retry(dir, opts); err != nil {
-				log.Println("Database unlocked, value log truncated")
-				return db, nil
-			}
-			log.Println("could not unlock database:", err)
+		unspent, err := bc.isUnspent(input.ID, input.Out)
+		if err != nil {
+			return err
 		}
-		return nil, err
-	}else {
-		return db, nil
+		if !unspent {
+			return fmt.Errorf("transaction %x spends %s, which is not unspent: %w", tx.ID, outpoint, ErrInvalidTransaction)
+		}
+
+		prevTX, height, err := bc.findTransactionHeight(input.ID)
+		if err != nil {
+			return err
+		}
+		if input.Out < 0 || input.Out >= len(prevTX.Outputs) {
+			return fmt.Errorf("transaction %x spends missing output %x:%d: %w", tx.ID, input.ID, input.Out, ErrInvalidTransaction)
+		}
+		if prevTX.IsCoinbase() && !bc.Params.CoinbaseMature(height, bestHeight+1) {
+			return fmt.Errorf("transaction %x spends immature coinbase %x: %w", tx.ID, input.ID, ErrInvalidTransaction)
+		}
+		prevTxs[hex.EncodeToString(prevTX.ID)] = prevTX
 	}
-}
\ No newline at end of file
+
+	if !tx.Verify(prevTxs) {
+		return fmt.Errorf("transaction %x has an invalid signature: %w", tx.ID, ErrInvalidTransaction)
+	}
+
+	if _, err := bc.checkValues(tx, prevTxs); err != nil {
+		return fmt.Errorf("transaction %x: %s: %w", tx.ID, err, ErrInvalidTransaction)
+	}
+
+	return nil
+}
+
@@ -0,0 +1,203 @@
+package blockchain
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// A bootstrap file holds a height range of the active chain, a new node
+// imports it instead of downloading every block from its peers:
+//
+//	magic("TBLK") format(uint8) First(int64) Last(int64)
+//	{ block as in encoding.go, prefixed with its length as a uint32 }
+//	sha256 of everything before it
+
+const (
+	bootstrapMagic = "TBLK"
+	BootstrapVersion = 1
+	bootstrapHeaderSize = len(bootstrapMagic) + 1 + 8 + 8
+	// largest encoded block read from a bootstrap file
+	maxBootstrapBlock = 4 << 20
+)
+
+var (
+	ErrBadBootstrap = errors.New("malformed bootstrap file")
+)
+
+// Bootstrap reads the blocks of a bootstrap file in order.
+type Bootstrap struct {
+	First						int
+	Last						int
+	reader						*bufio.Reader
+	next						int
+}
+
+
+// ExportChain writes the active chain from height first to last to w as a
+// bootstrap file. progress, if set, is called after each block.
+func (chain *BlockChain) ExportChain(w io.Writer, first, last int, progress func(height int)) error {
+	if chain.Light {
+		return errors.New("a light chain keeps no blocks to export")
+	}
+
+	bestHeight, err := chain.GetBestHeight()
+	if err != nil {
+		return err
+	}
+	if first < 0 || first > last || last > bestHeight {
+		return fmt.Errorf("heights %d to %d are not on the chain, its tip is at %d", first, last, bestHeight)
+	}
+
+	hasher := sha256.New()
+	out := io.MultiWriter(w, hasher)
+
+	var enc encoder
+	enc.buffer.WriteString(bootstrapMagic)
+	enc.uint8(BootstrapVersion)
+	enc.int(int64(first))
+	enc.int(int64(last))
+	if _, err := out.Write(enc.buffer.Bytes()); err != nil {
+		return err
+	}
+
+	for height := first; height <= last; height++ {
+		block, err := chain.GetBlockByHeight(height)
+		if err != nil {
+			return err
+		}
+
+		var enc encoder
+		enc.bytes(EncodeBlock(&block))
+		if _, err := out.Write(enc.buffer.Bytes()); err != nil {
+			return err
+		}
+
+		if progress != nil {
+			progress(height)
+		}
+	}
+
+	_, err = w.Write(hasher.Sum(nil))
+
+	return err
+}
+
+
+// OpenBootstrap checks the checksum of a bootstrap file and reads its height
+// range, no block is read before the whole file is known to be intact.
+func OpenBootstrap(file io.ReadSeeker) (*Bootstrap, error) {
+	size, err := file.Seek(0, io.SeekEnd)
+	if err != nil {
+		return nil, err
+	}
+	if size < int64(bootstrapHeaderSize+sha256.Size) {
+		return nil, fmt.Errorf("%w: %d bytes is too short", ErrBadBootstrap, size)
+	}
+	if _, err := file.Seek(0, io.SeekStart); err != nil {
+		return nil, err
+	}
+
+	hasher := sha256.New()
+	if _, err := io.CopyN(hasher, file, size-sha256.Size); err != nil {
+		return nil, err
+	}
+	checksum := make([]byte, sha256.Size)
+	if _, err := io.ReadFull(file, checksum); err != nil {
+		return nil, err
+	}
+	if !bytes.Equal(hasher.Sum(nil), checksum) {
+		return nil, fmt.Errorf("%w: checksum does not match", ErrBadBootstrap)
+	}
+
+	if _, err := file.Seek(0, io.SeekStart); err != nil {
+		return nil, err
+	}
+	reader := bufio.NewReader(io.LimitReader(file, size-sha256.Size))
+
+	header := make([]byte, bootstrapHeaderSize)
+	if _, err := io.ReadFull(reader, header); err != nil {
+		return nil, err
+	}
+	if string(header[:len(bootstrapMagic)]) != bootstrapMagic {
+		return nil, fmt.Errorf("%w: not a bootstrap file", ErrBadBootstrap)
+	}
+	if format := header[len(bootstrapMagic)]; format != BootstrapVersion {
+		return nil, fmt.Errorf("%w: unknown format version %d", ErrBadBootstrap, format)
+	}
+
+	first := int64(binary.BigEndian.Uint64(header[len(bootstrapMagic)+1:]))
+	last := int64(binary.BigEndian.Uint64(header[len(bootstrapMagic)+9:]))
+	if first < 0 || first > last {
+		return nil, fmt.Errorf("%w: bad height range %d to %d", ErrBadBootstrap, first, last)
+	}
+
+	return &Bootstrap{First: int(first), Last: int(last), reader: reader, next: int(first)}, nil
+}
+
+
+// Next returns the block at the next height of the file, io.EOF after Last.
+func (bootstrap *Bootstrap) Next() (*Block, error) {
+	if bootstrap.next > bootstrap.Last {
+		if _, err := bootstrap.reader.ReadByte(); err != io.EOF {
+			return nil, fmt.Errorf("%w: data after block %d", ErrBadBootstrap, bootstrap.Last)
+		}
+		return nil, io.EOF
+	}
+
+	var prefix [4]byte
+	if _, err := io.ReadFull(bootstrap.reader, prefix[:]); err != nil {
+		return nil, fmt.Errorf("%w: block %d is missing", ErrBadBootstrap, bootstrap.next)
+	}
+	length := binary.BigEndian.Uint32(prefix[:])
+	if length > maxBootstrapBlock {
+		return nil, fmt.Errorf("%w: block %d has %d bytes", ErrBadBootstrap, bootstrap.next, length)
+	}
+
+	data := make([]byte, length)
+	if _, err := io.ReadFull(bootstrap.reader, data); err != nil {
+		return nil, fmt.Errorf("%w: block %d is cut short", ErrBadBootstrap, bootstrap.next)
+	}
+
+	block, err := DecodeBlock(data)
+	if err != nil {
+		return nil, fmt.Errorf("block %d: %w", bootstrap.next, err)
+	}
+	if block.Height != bootstrap.next {
+		return nil, fmt.Errorf("%w: block %d found where block %d belongs", ErrBadBootstrap, block.Height, bootstrap.next)
+	}
+	bootstrap.next++
+
+	return &block, nil
+}
+
+
+// ImportChain adds the blocks of bootstrap through the normal validation, the
+// UTXO set follows block by block. Blocks the chain has are skipped. It
+// returns how many blocks were read, progress is called after each one.
+func (chain *BlockChain) ImportChain(bootstrap *Bootstrap, progress func(height int)) (int, error) {
+	count := 0
+
+	for {
+		block, err := bootstrap.Next()
+		if err == io.EOF {
+			return count, nil
+		}
+		if err != nil {
+			return count, err
+		}
+
+		if err := chain.AddBlock(block); err != nil {
+			return count, err
+		}
+		count++
+
+		if progress != nil {
+			progress(block.Height)
+		}
+	}
+}
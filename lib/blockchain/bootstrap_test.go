@@ -0,0 +1,138 @@
+package blockchain
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"testing"
+
+	"tensor/lib/storage"
+)
+
+// exportedChain mines a few blocks, one with a payment, and exports all of
+// them.
+func exportedChain(t *testing.T) (*BlockChain, []byte) {
+	t.Helper()
+
+	chain, miner := newTestChain(t, testParams())
+	address := string(miner.Address())
+
+	genesis := tipBlock(t, chain)
+	parent := mineOn(t, chain, genesis, address)
+	parent = mineOn(t, chain, parent, address, payTo(t, chain, miner, genesis.Transactions[0], 0, output(t, address, 20)))
+	for height := 3; height <= 5; height++ {
+		parent = mineOn(t, chain, parent, address)
+	}
+
+	var file bytes.Buffer
+	var exported []int
+	if err := chain.ExportChain(&file, 0, 5, func(height int) { exported = append(exported, height) }); err != nil {
+		t.Fatal(err)
+	}
+	if len(exported) != 6 || exported[5] != 5 {
+		t.Fatalf("progress saw heights %v", exported)
+	}
+
+	return chain, file.Bytes()
+}
+
+
+func TestBootstrapRoundTrip(t *testing.T) {
+	source, file := exportedChain(t)
+	genesis, err := source.GetBlockByHeight(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	chain, err := CreateBlockChainFromGenesis(storage.NewMemory(), source.Engine, &genesis)
+	if err != nil {
+		t.Fatal(err)
+	}
+	useTestSettings(t, chain, source.Params)
+
+	// a second import finds every block known and changes nothing
+	for i := 0; i < 2; i++ {
+		bootstrap, err := OpenBootstrap(bytes.NewReader(file))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if bootstrap.First != 0 || bootstrap.Last != 5 {
+			t.Fatalf("bootstrap holds heights %d to %d", bootstrap.First, bootstrap.Last)
+		}
+
+		count, err := chain.ImportChain(bootstrap, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if count != 6 {
+			t.Fatalf("imported %d blocks, want 6", count)
+		}
+		if !bytes.Equal(chain.Tip(), source.Tip()) {
+			t.Fatalf("tip is %x, want %x", chain.Tip(), source.Tip())
+		}
+		checkUTXOs(t, chain)
+	}
+
+	if got, want := len(storedUTXOs(t, chain)), len(storedUTXOs(t, source)); got != want {
+		t.Fatalf("imported chain has %d unspent outputs, want %d", got, want)
+	}
+}
+
+
+func TestBootstrapCorrupt(t *testing.T) {
+	_, file := exportedChain(t)
+
+	tampered := append([]byte{}, file...)
+	tampered[len(tampered)/2] ^= 0x01
+
+	tests := []struct {
+		name						string
+		data						[]byte
+	}{
+		{"tampered", tampered},
+		{"truncated", file[:len(file)-1]},
+		{"short", file[:10]},
+		{"empty", nil},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if _, err := OpenBootstrap(bytes.NewReader(test.data)); !errors.Is(err, ErrBadBootstrap) {
+				t.Fatalf("opening gave %v, want ErrBadBootstrap", err)
+			}
+		})
+	}
+}
+
+
+func TestExportRange(t *testing.T) {
+	chain, _ := exportedChain(t)
+
+	for _, heights := range [][2]int{{-1, 2}, {3, 2}, {0, 6}} {
+		var file bytes.Buffer
+		if err := chain.ExportChain(&file, heights[0], heights[1], nil); err == nil {
+			t.Fatalf("exported heights %d to %d", heights[0], heights[1])
+		}
+	}
+
+	var file bytes.Buffer
+	if err := chain.ExportChain(&file, 2, 4, nil); err != nil {
+		t.Fatal(err)
+	}
+	bootstrap, err := OpenBootstrap(bytes.NewReader(file.Bytes()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for height := 2; height <= 4; height++ {
+		block, err := bootstrap.Next()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if block.Height != height {
+			t.Fatalf("read block %d, want %d", block.Height, height)
+		}
+	}
+	if _, err := bootstrap.Next(); err != io.EOF {
+		t.Fatalf("reading past the last block gave %v, want io.EOF", err)
+	}
+}
@@ -1,36 +1,37 @@
 package blockchain
 
-import "github.com/dgraph-io/badger"
+import "tensor/lib/storage"
 
 type BlockChainIterator struct {
 	CurrentHash					[]byte
-	Database					*badger.DB
+	chain						*BlockChain
 }
 
 
 func (chain *BlockChain) Iterator() *BlockChainIterator {
-	iter := &BlockChainIterator{chain.LastHash, chain.Database}
+	iter := &BlockChainIterator{chain.Tip(), chain}
 
 	return iter
 }
 
 
-func (iter *BlockChainIterator) Next() *Block {
+func (iter *BlockChainIterator) Next() (*Block, error) {
 	var block *Block
 
-	err := iter.Database.View(func(txn *badger.Txn) error {
-		item, err := txn.Get(iter.CurrentHash)
-		HandleError(err)
-
-		encodedBlock, err := item.ValueCopy([]byte("lh"))
-		
-		block = Deserialize(encodedBlock)
+	err := iter.chain.view(func(txn storage.Txn) error {
+		encodedBlock, err := iter.chain.getBlockData(txn, iter.CurrentHash)
+		if err != nil {
+			return err
+		}
 
+		block, err = Deserialize(encodedBlock)
 		return err
 	})
-	HandleError(err)
+	if err != nil {
+		return nil, err
+	}
 
 	iter.CurrentHash = block.PrevHash
 
-	return block
-}
\ No newline at end of file
+	return block, nil
+}
@@ -0,0 +1,120 @@
+package blockchain
+
+import (
+	"bytes"
+	"errors"
+	"tensor/lib/storage"
+)
+
+// A full node syncing from scratch first fetches the headers up to the last
+// checkpoint. Their hashes link them to the pinned checkpoint, so they are its
+// ancestors whatever their seals say, and the signatures in their blocks are
+// not checked again. A run that does not reach the checkpoint marks nothing.
+
+var (
+	assumedprefix = []byte("assumed-")
+)
+
+
+func assumedKey(hash []byte) []byte {
+	return append(append([]byte{}, assumedprefix...), hash...)
+}
+
+
+// assumedValid reports whether hash was proven to lead to the last
+// checkpoint.
+func (chain *BlockChain) assumedValid(hash []byte) (bool, error) {
+	err := chain.view(func(txn storage.Txn) error {
+		_, err := txn.Get(assumedKey(hash))
+		return err
+	})
+	if errors.Is(err, ErrNotFound) {
+		return false, nil
+	}
+
+	return err == nil, err
+}
+
+
+// CheckpointSynced reports whether blocks can be fetched, the headers leading
+// to the last checkpoint are known or not needed.
+func (chain *BlockChain) CheckpointSynced() (bool, error) {
+	checkpoint, ok := chain.Params.LastCheckpoint()
+	if !ok || chain.Light {
+		return true, nil
+	}
+
+	height, err := chain.GetBestHeight()
+	if err != nil {
+		return false, err
+	}
+	if height >= checkpoint.Height {
+		return true, nil
+	}
+
+	return chain.assumedValid(checkpoint.Hash)
+}
+
+
+// AddCheckpointHeaders extends the run of headers towards the last
+// checkpoint. A run starts from a stored block and replaces the one before.
+// Once it reaches the checkpoint its headers are marked and it reports true.
+func (chain *BlockChain) AddCheckpointHeaders(headers []*BlockHeader) (bool, error) {
+	chain.mutex.Lock()
+	defer chain.mutex.Unlock()
+
+	checkpoint, ok := chain.Params.LastCheckpoint()
+	if !ok || chain.Light {
+		return true, nil
+	}
+
+	run := chain.checkpointHeaders
+	chain.checkpointHeaders = nil
+
+	for _, header := range headers {
+		hash := header.Hash()
+		if header.Height > checkpoint.Height {
+			break
+		}
+
+		var parentHeight int
+		if last := len(run) - 1; last >= 0 && bytes.Equal(header.PrevHash, run[last].Hash()) {
+			parentHeight = run[last].Height
+		}else {
+			parent, err := chain.GetBlockHeader(header.PrevHash)
+			if errors.Is(err, ErrNotFound) {
+				return false, reject(hash, RejectUnknownParent, "previous block %x is not known", header.PrevHash)
+			}
+			if err != nil {
+				return false, err
+			}
+			parentHeight = parent.Height
+			run = nil
+		}
+
+		if header.Height != parentHeight+1 {
+			return false, reject(hash, RejectBadHeight, "height %d does not follow parent height %d", header.Height, parentHeight)
+		}
+		if pinned, ok := chain.Params.CheckpointAt(header.Height); ok && !bytes.Equal(pinned, hash) {
+			return false, reject(hash, RejectCheckpoint, "checkpoint at height %d is %x", header.Height, pinned)
+		}
+
+		run = append(run, header)
+	}
+
+	if len(run) == 0 || run[len(run)-1].Height != checkpoint.Height {
+		chain.checkpointHeaders = run
+		return false, nil
+	}
+
+	err := chain.update(func(txn storage.Txn) error {
+		for _, header := range run {
+			if err := txn.Put(assumedKey(header.Hash()), []byte{1}); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+
+	return err == nil, err
+}
@@ -0,0 +1,124 @@
+package blockchain
+
+import (
+	"bytes"
+	"testing"
+
+	"tensor/lib/storage"
+	"tensor/lib/wallet"
+)
+
+// checkpointRun seals three blocks on the genesis of source, the first with a
+// forged signature, and pins the third as the checkpoint of params. source
+// keeps their headers only, so the blocks can be added elsewhere.
+func checkpointRun(t *testing.T, source *BlockChain, params *ChainParams, miner *wallet.Wallet) []*Block {
+	t.Helper()
+
+	address := string(miner.Address())
+	genesis := tipBlock(t, source)
+	forged := payTo(t, source, miner, genesis.Transactions[0], 0, output(t, address, 20))
+	forged.Inputs[0].Signature[10] ^= 0xff
+
+	var blocks []*Block
+	parent := genesis
+	for _, txs := range [][]*Transaction{{coinbaseTx(t, address, 20), forged}, {coinbaseTx(t, address, 20)}, {coinbaseTx(t, address, 20)}} {
+		block := sealBlock(t, source, parent, txs, nil)
+		err := source.update(func(txn storage.Txn) error {
+			return storeBlock(txn, block, source.Engine.Weight(&block.BlockHeader))
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		blocks = append(blocks, block)
+		parent = block
+	}
+
+	params.Checkpoints = []Checkpoint{{3, parent.Hash}}
+
+	return blocks
+}
+
+
+func TestSignaturesSkippedBelowProvenCheckpoint(t *testing.T) {
+	params := testParams()
+	source, miner := newTestChain(t, params)
+	blocks := checkpointRun(t, source, params, miner)
+	headers := []*BlockHeader{&blocks[0].BlockHeader, &blocks[1].BlockHeader, &blocks[2].BlockHeader}
+
+	genesis := tipBlock(t, source)
+	chain, err := CreateBlockChainFromGenesis(storage.NewMemory(), source.Engine, genesis)
+	if err != nil {
+		t.Fatal(err)
+	}
+	useTestSettings(t, chain, params)
+	chain.Clock.(*testClock).catchUp(blocks[2].TimeStamp)
+
+	// below the checkpoint alone does not prove a block leads to it
+	if err := chain.AddBlock(blocks[0]); rejectCode(err) != RejectInvalidTransaction {
+		t.Fatalf("forged signature before the headers gave %v", err)
+	}
+
+	if _, err := chain.AddCheckpointHeaders(headers[1:]); rejectCode(err) != RejectUnknownParent {
+		t.Fatalf("headers that do not connect gave %v", err)
+	}
+
+	synced, err := chain.AddCheckpointHeaders(headers[:2])
+	if err != nil || synced {
+		t.Fatalf("headers short of the checkpoint gave %t, %v", synced, err)
+	}
+	if locator, err := chain.Locator(); err != nil || !bytes.Equal(locator[0], blocks[1].Hash) {
+		t.Fatalf("locator does not continue from the headers already fetched, %v", err)
+	}
+	if err := chain.AddBlock(blocks[0]); rejectCode(err) != RejectInvalidTransaction {
+		t.Fatalf("forged signature before the checkpoint header gave %v", err)
+	}
+
+	synced, err = chain.AddCheckpointHeaders(headers[2:])
+	if err != nil || !synced {
+		t.Fatalf("checkpoint header gave %t, %v", synced, err)
+	}
+	if synced, err := chain.CheckpointSynced(); err != nil || !synced {
+		t.Fatalf("chain is not synced to the checkpoint, %v", err)
+	}
+
+	for _, block := range blocks {
+		if err := chain.AddBlock(block); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if !bytes.Equal(chain.Tip(), blocks[2].Hash) {
+		t.Fatalf("tip is %x, want the checkpoint", chain.Tip())
+	}
+}
+
+
+func TestCheckpointHeadersMismatch(t *testing.T) {
+	params := testParams()
+	source, miner := newTestChain(t, params)
+	address := string(miner.Address())
+	blocks := checkpointRun(t, source, params, miner)
+
+	genesis := tipBlock(t, source)
+	chain, err := CreateBlockChainFromGenesis(storage.NewMemory(), source.Engine, genesis)
+	if err != nil {
+		t.Fatal(err)
+	}
+	useTestSettings(t, chain, params)
+
+	if synced, err := chain.CheckpointSynced(); err != nil || synced {
+		t.Fatalf("new chain is synced to the checkpoint, %v", err)
+	}
+
+	other := sealBlock(t, source, blocks[1], []*Transaction{coinbaseTx(t, address, 20)}, nil)
+	headers := []*BlockHeader{&blocks[0].BlockHeader, &blocks[1].BlockHeader, &other.BlockHeader}
+	if _, err := chain.AddCheckpointHeaders(headers); rejectCode(err) != RejectCheckpoint {
+		t.Fatalf("headers leading to another block gave %v", err)
+	}
+
+	// nothing was marked on the way
+	for _, block := range blocks {
+		if assumed, err := chain.assumedValid(block.Hash); err != nil || assumed {
+			t.Fatalf("block %d is marked, %v", block.Height, err)
+		}
+	}
+}
@@ -0,0 +1,98 @@
+package blockchain
+
+import (
+	"sort"
+	"time"
+)
+
+// Clock is where the chain reads the current time, tests swap it for one
+// they control.
+type Clock interface {
+	Now() time.Time
+}
+
+type systemClock struct{}
+
+var (
+	SystemClock Clock = systemClock{}
+)
+
+
+func (systemClock) Now() time.Time {
+	return time.Now()
+}
+
+
+func (chain *BlockChain) now() time.Time {
+	if chain.Clock == nil {
+		return SystemClock.Now()
+	}
+
+	return chain.Clock.Now()
+}
+
+
+// MedianTimePast is the median timestamp of parent and the blocks before it,
+// MedianTimeSpan blocks at most. The block after parent has to be later.
+func (chain *BlockChain) MedianTimePast(parent *BlockHeader) (int64, error) {
+	var timestamps []int64
+
+	header := *parent
+	for {
+		timestamps = append(timestamps, header.TimeStamp)
+
+		if len(timestamps) == chain.Params.MedianTimeSpan || len(header.PrevHash) == 0 {
+			break
+		}
+
+		prev, err := chain.GetBlockHeader(header.PrevHash)
+		if err != nil {
+			return 0, err
+		}
+		header = prev
+	}
+
+	sort.Slice(timestamps, func(i, j int) bool { return timestamps[i] < timestamps[j] })
+
+	return timestamps[len(timestamps)/2], nil
+}
+
+
+// checkTimestamp rejects a header that is not after the median time past of
+// its parent, or too far ahead of the local clock. parent is nil for genesis.
+func (chain *BlockChain) checkTimestamp(header, parent *BlockHeader) error {
+	hash := header.Hash()
+
+	if parent != nil {
+		median, err := chain.MedianTimePast(parent)
+		if err != nil {
+			return err
+		}
+		if header.TimeStamp <= median {
+			return reject(hash, RejectBadTimestamp, "timestamp %d is not after the median time %d", header.TimeStamp, median)
+		}
+	}
+
+	if limit := chain.now().Unix() + chain.Params.MaxFutureDrift; header.TimeStamp > limit {
+		return reject(hash, RejectBadTimestamp, "timestamp %d is more than %d seconds ahead of local time", header.TimeStamp, chain.Params.MaxFutureDrift)
+	}
+
+	return nil
+}
+
+
+// nextTimestamp is the time for a block on top of parent: now, unless the
+// median time past is not behind it yet.
+func (chain *BlockChain) nextTimestamp(parent *BlockHeader) (int64, error) {
+	median, err := chain.MedianTimePast(parent)
+	if err != nil {
+		return 0, err
+	}
+
+	timestamp := chain.now().Unix()
+	if timestamp <= median {
+		timestamp = median + 1
+	}
+
+	return timestamp, nil
+}
@@ -0,0 +1,103 @@
+package blockchain
+
+import (
+	"math/big"
+)
+
+// Targets are stored in blocks in the compact form used by bitcoin: the top
+// byte is the length of the target in bytes and the lower three bytes are its
+// most significant digits.
+
+func CompactToBig(compact uint32) *big.Int {
+	mantissa := int64(compact & 0x007fffff)
+	exponent := uint(compact >> 24)
+
+	if exponent <= 3 {
+		return big.NewInt(mantissa >> (8 * (3 - exponent)))
+	}
+
+	target := big.NewInt(mantissa)
+	return target.Lsh(target, 8*(exponent-3))
+}
+
+
+func BigToCompact(target *big.Int) uint32 {
+	if target.Sign() <= 0 {
+		return 0
+	}
+
+	var mantissa uint32
+	exponent := uint(len(target.Bytes()))
+
+	if exponent <= 3 {
+		mantissa = uint32(target.Uint64()) << (8 * (3 - exponent))
+	}else {
+		shifted := new(big.Int).Rsh(target, 8*(exponent-3))
+		mantissa = uint32(shifted.Uint64())
+	}
+
+	if mantissa&0x00800000 != 0 {
+		mantissa >>= 8
+		exponent++
+	}
+
+	return uint32(exponent<<24) | mantissa
+}
+
+
+// CalcNextBits returns the Bits the block after parent has to have under the
+// engine of the chain.
+func (chain *BlockChain) CalcNextBits(parent *BlockHeader) (uint32, error) {
+	return chain.Engine.CalcDifficulty(chain, parent)
+}
+
+
+// CalcDifficulty returns the target the block after parent has to meet. The
+// target only changes every RetargetInterval blocks, scaled by how long the
+// last window took compared to TargetBlockTime.
+func (engine *PowEngine) CalcDifficulty(chain ChainReader, parent *BlockHeader) (uint32, error) {
+	params := engine.Params
+
+	if parent == nil {
+		return params.GenesisBits, nil
+	}
+
+	height := parent.Height + 1
+
+	if height%params.RetargetInterval != 0 {
+		return parent.Bits, nil
+	}
+
+	first := *parent
+	for first.Height > height-params.RetargetInterval && len(first.PrevHash) > 0 {
+		header, err := chain.GetBlockHeader(first.PrevHash)
+		if err != nil {
+			return 0, err
+		}
+		first = header
+	}
+
+	expected := params.TargetBlockTime * int64(parent.Height-first.Height)
+	actual := parent.TimeStamp - first.TimeStamp
+
+	if actual < expected/params.MaxRetargetFactor {
+		actual = expected / params.MaxRetargetFactor
+	}
+	if actual > expected*params.MaxRetargetFactor {
+		actual = expected * params.MaxRetargetFactor
+	}
+
+	if expected == 0 {
+		return parent.Bits, nil
+	}
+
+	target := CompactToBig(parent.Bits)
+	target.Mul(target, big.NewInt(actual))
+	target.Div(target, big.NewInt(expected))
+
+	if target.Cmp(params.PowLimit) > 0 {
+		target.Set(params.PowLimit)
+	}
+
+	return BigToCompact(target), nil
+}
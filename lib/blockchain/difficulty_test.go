@@ -0,0 +1,141 @@
+package blockchain
+
+import (
+	"encoding/hex"
+	"fmt"
+	"math/big"
+	"testing"
+)
+
+// headerMap is a ChainReader over headers kept in memory.
+type headerMap map[string]BlockHeader
+
+
+func (headers headerMap) GetBlockHeader(blockHash []byte) (BlockHeader, error) {
+	header, ok := headers[hex.EncodeToString(blockHash)]
+	if !ok {
+		return BlockHeader{}, fmt.Errorf("header %x: %w", blockHash, ErrNotFound)
+	}
+
+	return header, nil
+}
+
+
+// window links count headers with bits, spacing seconds apart, and returns
+// the last.
+func (headers headerMap) window(count int, bits uint32, spacing int64) *BlockHeader {
+	var prevHash []byte
+	var header BlockHeader
+
+	for height := 0; height < count; height++ {
+		header = BlockHeader{Version: BlockVersion, PrevHash: prevHash, TimeStamp: 1000000 + spacing*int64(height), Bits: bits, Height: height}
+		prevHash = header.Hash()
+		headers[hex.EncodeToString(prevHash)] = header
+	}
+
+	return &header
+}
+
+
+func TestCompactVectors(t *testing.T) {
+	tests := []struct {
+		compact						uint32
+		target						*big.Int
+	}{
+		{0x1d00ffff, new(big.Int).Lsh(big.NewInt(0xffff), 208)},
+		{0x20010000, new(big.Int).Lsh(big.NewInt(1), 248)},
+		{0x03123456, big.NewInt(0x123456)},
+		{0x01120000, big.NewInt(0x12)},
+		// the mantissa is signed, a high bit moves into the next byte
+		{0x02008000, big.NewInt(0x80)},
+	}
+
+	for _, test := range tests {
+		if target := CompactToBig(test.compact); target.Cmp(test.target) != 0 {
+			t.Fatalf("CompactToBig(%08x) = %x, want %x", test.compact, target, test.target)
+		}
+		if compact := BigToCompact(test.target); compact != test.compact {
+			t.Fatalf("BigToCompact(%x) = %08x, want %08x", test.target, compact, test.compact)
+		}
+	}
+
+	if compact := BigToCompact(big.NewInt(0)); compact != 0 {
+		t.Fatalf("BigToCompact(0) = %08x", compact)
+	}
+}
+
+
+func TestCalcDifficulty(t *testing.T) {
+	params := DefaultParams
+	params.RetargetInterval = 5
+	engine := NewPowEngine(&params, MinerConfig{Workers: 1})
+	limit := BigToCompact(params.PowLimit)
+
+	// a window of 5 blocks spans 4 intervals of TargetBlockTime, 120 seconds
+	tests := []struct {
+		name						string
+		count						int
+		bits						uint32
+		spacing						int64
+		want						uint32
+	}{
+		{"between retargets", 6, 0x1d00ffff, 1, 0x1d00ffff},
+		{"on time", 5, 0x1d00ffff, 30, 0x1d00ffff},
+		{"twice as fast", 5, 0x1d00ffff, 15, 0x1c7fff80},
+		{"twice as slow", 5, 0x1d00ffff, 60, 0x1d01fffe},
+		{"clamped fast", 5, 0x1d00ffff, 1, 0x1c3fffc0},
+		{"clamped slow", 5, 0x1d00ffff, 1000, 0x1d03fffc},
+		{"capped at the limit", 5, limit, 60, limit},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			headers := make(headerMap)
+			parent := headers.window(test.count, test.bits, test.spacing)
+
+			bits, err := engine.CalcDifficulty(headers, parent)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if bits != test.want {
+				t.Fatalf("bits are %08x, want %08x", bits, test.want)
+			}
+		})
+	}
+
+	if bits, err := engine.CalcDifficulty(make(headerMap), nil); err != nil || bits != params.GenesisBits {
+		t.Fatalf("genesis bits are %08x, %v, want %08x", bits, err, params.GenesisBits)
+	}
+}
+
+
+func TestRetargetOnChain(t *testing.T) {
+	params := testParams()
+	params.RetargetInterval = 5
+	params.GenesisBits = BigToCompact(new(big.Int).Rsh(params.PowLimit, 2))
+	chain, miner := newTestChain(t, params)
+	address := string(miner.Address())
+
+	// blocks come in twice as fast as TargetBlockTime
+	parent := tipBlock(t, chain)
+	for height := 1; height <= 5; height++ {
+		coinbase := coinbaseTx(t, address, params.BlockSubsidy(height))
+		block := sealBlock(t, chain, parent, []*Transaction{coinbase}, func(header *BlockHeader) {
+			header.TimeStamp = parent.TimeStamp + params.TargetBlockTime/2
+		})
+		if err := chain.AddBlock(block); err != nil {
+			t.Fatal(err)
+		}
+
+		if height < 5 && block.Bits != params.GenesisBits {
+			t.Fatalf("bits changed to %08x at height %d", block.Bits, height)
+		}
+		if height == 5 {
+			want := BigToCompact(new(big.Int).Rsh(params.PowLimit, 3))
+			if block.Bits != want {
+				t.Fatalf("bits at the retarget are %08x, want %08x", block.Bits, want)
+			}
+		}
+		parent = block
+	}
+}
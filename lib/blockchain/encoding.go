@@ -0,0 +1,395 @@
+package blockchain
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/gob"
+	"errors"
+	"fmt"
+)
+
+// Blocks and transactions are hashed, stored and sent to peers in the format
+// below. Integers are big endian, Go ints are written as int64 and byte
+// strings are prefixed with their length as a uint32.
+//
+//	header:       format(uint8) Version PrevHash MerkleRoot TimeStamp Bits(uint32) Nonce Height
+//	              { Signer Signature, for format SignedHeaderVersion only }
+//	block:        header Hash count(uint32) { transaction, prefixed with its length }
+//	transaction:  format(uint8) ID count(uint32) { input } count(uint32) { output }
+//	input:        ID Out Signature PubKey
+//	              { Signature is r and s, 32 bytes each, 64 bytes in all }
+//	output:       Value PubKeyHash
+//	merkle proof: format(uint8) BlockHash Transaction Index count(uint32) { hash }
+//
+// A transaction id is the sha256 of the transaction encoded with an empty ID
+// and empty signatures. A block hash is the sha256 of its encoded header.
+
+const (
+	EncodingVersion = 1
+	// headers sealed by an authority carry its key and signature
+	SignedHeaderVersion = 2
+)
+
+var (
+	ErrEncoding = errors.New("malformed encoding")
+)
+
+type encoder struct {
+	buffer						bytes.Buffer
+}
+
+type decoder struct {
+	data						[]byte
+	err							error
+}
+
+
+func (enc *encoder) uint8(value uint8) {
+	enc.buffer.WriteByte(value)
+}
+
+
+func (enc *encoder) uint32(value uint32) {
+	var buff [4]byte
+	binary.BigEndian.PutUint32(buff[:], value)
+	enc.buffer.Write(buff[:])
+}
+
+
+func (enc *encoder) int(value int64) {
+	var buff [8]byte
+	binary.BigEndian.PutUint64(buff[:], uint64(value))
+	enc.buffer.Write(buff[:])
+}
+
+
+func (enc *encoder) bytes(value []byte) {
+	enc.uint32(uint32(len(value)))
+	enc.buffer.Write(value)
+}
+
+
+func (enc *encoder) header(header *BlockHeader) {
+	signed := len(header.Signer) > 0 || len(header.Signature) > 0
+
+	if signed {
+		enc.uint8(SignedHeaderVersion)
+	}else {
+		enc.uint8(EncodingVersion)
+	}
+	enc.int(int64(header.Version))
+	enc.bytes(header.PrevHash)
+	enc.bytes(header.MerkleRoot)
+	enc.int(header.TimeStamp)
+	enc.uint32(header.Bits)
+	enc.int(int64(header.Nonce))
+	enc.int(int64(header.Height))
+
+	if signed {
+		enc.bytes(header.Signer)
+		enc.bytes(header.Signature)
+	}
+}
+
+
+func (enc *encoder) transaction(tx *Transaction) {
+	enc.uint8(EncodingVersion)
+	enc.bytes(tx.ID)
+
+	enc.uint32(uint32(len(tx.Inputs)))
+	for _, input := range tx.Inputs {
+		enc.bytes(input.ID)
+		enc.int(int64(input.Out))
+		enc.bytes(input.Signature)
+		enc.bytes(input.PubKey)
+	}
+
+	enc.uint32(uint32(len(tx.Outputs)))
+	for _, output := range tx.Outputs {
+		enc.int(int64(output.Value))
+		enc.bytes(output.PubKeyHash)
+	}
+}
+
+
+func (enc *encoder) block(block *Block) {
+	enc.header(&block.BlockHeader)
+	enc.bytes(block.Hash)
+
+	enc.uint32(uint32(len(block.Transactions)))
+	for _, tx := range block.Transactions {
+		enc.bytes(EncodeTransaction(tx))
+	}
+}
+
+
+func (enc *encoder) merkleProof(proof *MerkleProof) {
+	enc.uint8(EncodingVersion)
+	enc.bytes(proof.BlockHash)
+	enc.bytes(proof.Transaction)
+	enc.int(int64(proof.Index))
+
+	enc.uint32(uint32(len(proof.Hashes)))
+	for _, hash := range proof.Hashes {
+		enc.bytes(hash)
+	}
+}
+
+
+func (dec *decoder) fail(format string, args ...interface{}) {
+	if dec.err == nil {
+		dec.err = fmt.Errorf("%w: %s", ErrEncoding, fmt.Sprintf(format, args...))
+	}
+}
+
+
+func (dec *decoder) next(n int) []byte {
+	if dec.err != nil {
+		return nil
+	}
+	if n < 0 || n > len(dec.data) {
+		dec.fail("need %d bytes, have %d", n, len(dec.data))
+		return nil
+	}
+
+	value := dec.data[:n]
+	dec.data = dec.data[n:]
+
+	return value
+}
+
+
+func (dec *decoder) uint8() uint8 {
+	if value := dec.next(1); value != nil {
+		return value[0]
+	}
+	return 0
+}
+
+
+func (dec *decoder) uint32() uint32 {
+	if value := dec.next(4); value != nil {
+		return binary.BigEndian.Uint32(value)
+	}
+	return 0
+}
+
+
+func (dec *decoder) int() int64 {
+	if value := dec.next(8); value != nil {
+		return int64(binary.BigEndian.Uint64(value))
+	}
+	return 0
+}
+
+
+func (dec *decoder) bytes() []byte {
+	length := dec.uint32()
+	if uint64(length) > uint64(len(dec.data)) {
+		dec.fail("length %d is past the end of the data", length)
+		return nil
+	}
+
+	return append([]byte{}, dec.next(int(length))...)
+}
+
+
+// count reads the number of items that follow, each at least minSize bytes.
+func (dec *decoder) count(minSize int) int {
+	count := dec.uint32()
+	if uint64(count)*uint64(minSize) > uint64(len(dec.data)) {
+		dec.fail("%d items do not fit in the data", count)
+		return 0
+	}
+
+	return int(count)
+}
+
+
+func (dec *decoder) version() {
+	if version := dec.uint8(); dec.err == nil && version != EncodingVersion {
+		dec.fail("unknown format version %d", version)
+	}
+}
+
+
+func (dec *decoder) header() BlockHeader {
+	var header BlockHeader
+
+	format := dec.uint8()
+	if dec.err == nil && format != EncodingVersion && format != SignedHeaderVersion {
+		dec.fail("unknown header format %d", format)
+	}
+	header.Version = int(dec.int())
+	header.PrevHash = dec.bytes()
+	header.MerkleRoot = dec.bytes()
+	header.TimeStamp = dec.int()
+	header.Bits = dec.uint32()
+	header.Nonce = int(dec.int())
+	header.Height = int(dec.int())
+
+	if format == SignedHeaderVersion {
+		header.Signer = dec.bytes()
+		header.Signature = dec.bytes()
+	}
+
+	return header
+}
+
+
+func (dec *decoder) transaction() Transaction {
+	var tx Transaction
+
+	dec.version()
+	tx.ID = dec.bytes()
+
+	inputs := dec.count(20)
+	for i := 0; i < inputs && dec.err == nil; i++ {
+		var input TxInput
+		input.ID = dec.bytes()
+		input.Out = int(dec.int())
+		input.Signature = dec.bytes()
+		input.PubKey = dec.bytes()
+		tx.Inputs = append(tx.Inputs, input)
+	}
+
+	outputs := dec.count(12)
+	for i := 0; i < outputs && dec.err == nil; i++ {
+		var output TxOutput
+		output.Value = int(dec.int())
+		output.PubKeyHash = dec.bytes()
+		tx.Outputs = append(tx.Outputs, output)
+	}
+
+	return tx
+}
+
+
+func (dec *decoder) block() Block {
+	var block Block
+
+	block.BlockHeader = dec.header()
+	block.Hash = dec.bytes()
+
+	count := dec.count(4)
+	for i := 0; i < count && dec.err == nil; i++ {
+		tx, err := DecodeTransaction(dec.bytes())
+		if err != nil && dec.err == nil {
+			dec.err = err
+		}
+		block.Transactions = append(block.Transactions, &tx)
+	}
+
+	return block
+}
+
+
+func (dec *decoder) merkleProof() MerkleProof {
+	var proof MerkleProof
+
+	dec.version()
+	proof.BlockHash = dec.bytes()
+	proof.Transaction = dec.bytes()
+	proof.Index = int(dec.int())
+
+	count := dec.count(4)
+	for i := 0; i < count && dec.err == nil; i++ {
+		proof.Hashes = append(proof.Hashes, dec.bytes())
+	}
+
+	return proof
+}
+
+
+// finish fails the decoding if data is left over.
+func (dec *decoder) finish() error {
+	if dec.err == nil && len(dec.data) > 0 {
+		dec.fail("%d trailing bytes", len(dec.data))
+	}
+
+	return dec.err
+}
+
+
+func EncodeHeader(header *BlockHeader) []byte {
+	var enc encoder
+	enc.header(header)
+
+	return enc.buffer.Bytes()
+}
+
+
+func DecodeHeader(data []byte) (BlockHeader, error) {
+	dec := decoder{data: data}
+	header := dec.header()
+
+	return header, dec.finish()
+}
+
+
+func EncodeTransaction(tx *Transaction) []byte {
+	var enc encoder
+	enc.transaction(tx)
+
+	return enc.buffer.Bytes()
+}
+
+
+func DecodeTransaction(data []byte) (Transaction, error) {
+	dec := decoder{data: data}
+	tx := dec.transaction()
+
+	return tx, dec.finish()
+}
+
+
+func EncodeBlock(block *Block) []byte {
+	var enc encoder
+	enc.block(block)
+
+	return enc.buffer.Bytes()
+}
+
+
+func DecodeBlock(data []byte) (Block, error) {
+	dec := decoder{data: data}
+	block := dec.block()
+
+	return block, dec.finish()
+}
+
+
+func EncodeMerkleProof(proof *MerkleProof) []byte {
+	var enc encoder
+	enc.merkleProof(proof)
+
+	return enc.buffer.Bytes()
+}
+
+
+func DecodeMerkleProof(data []byte) (MerkleProof, error) {
+	dec := decoder{data: data}
+	proof := dec.merkleProof()
+
+	return proof, dec.finish()
+}
+
+
+// encodeLegacy writes the records that are still kept in encoding/gob: UTXOs,
+// undo data and index entries. Their types are plain structs gob always
+// encodes, an error means the type itself is broken.
+func encodeLegacy(value interface{}) []byte {
+	var buffer bytes.Buffer
+	if err := gob.NewEncoder(&buffer).Encode(value); err != nil {
+		panic(fmt.Sprintf("gob encoding %T: %v", value, err))
+	}
+
+	return buffer.Bytes()
+}
+
+
+// decodeLegacy reads records written with encoding/gob before the format
+// above existed.
+func decodeLegacy(data []byte, value interface{}) error {
+	return gob.NewDecoder(bytes.NewReader(data)).Decode(value)
+}
@@ -0,0 +1,185 @@
+package blockchain
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/gob"
+	"encoding/hex"
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// unhex reads a test vector, spaces are only there to make it readable.
+func unhex(t *testing.T, vector string) []byte {
+	t.Helper()
+
+	data, err := hex.DecodeString(strings.Join(strings.Fields(vector), ""))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return data
+}
+
+
+func TestTransactionVector(t *testing.T) {
+	tx := Transaction{[]byte{0xaa, 0xbb}, []TxInput{{[]byte{0x01}, 2, []byte{0x03, 0x04}, []byte{0x05}}}, []TxOutput{{7, []byte{0x08, 0x09}}}}
+	vector := unhex(t, `01 00000002aabb
+		00000001 0000000101 0000000000000002 000000020304 0000000105
+		00000001 0000000000000007 000000020809`)
+
+	if encoded := EncodeTransaction(&tx); !bytes.Equal(encoded, vector) {
+		t.Fatalf("encoded to %x, want %x", encoded, vector)
+	}
+
+	decoded, err := DecodeTransaction(vector)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(decoded, tx) {
+		t.Fatalf("decoded to %+v, want %+v", decoded, tx)
+	}
+}
+
+
+func TestHeaderVector(t *testing.T) {
+	header := BlockHeader{Version: 1, PrevHash: []byte{0x11}, MerkleRoot: []byte{0x22, 0x33}, TimeStamp: 0x0102030405, Bits: 0x1f00ffff, Nonce: 9, Height: 3}
+	fields := `0000000000000001 0000000111 000000022233 0000000102030405 1f00ffff
+		0000000000000009 0000000000000003`
+
+	tests := []struct {
+		name						string
+		signer						[]byte
+		signature					[]byte
+		vector						string
+	}{
+		{"proof of work", nil, nil, "01 " + fields},
+		{"signed", []byte{0x44}, []byte{0x55, 0x66}, "02 " + fields + " 0000000144 000000025566"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			header := header
+			header.Signer = test.signer
+			header.Signature = test.signature
+			vector := unhex(t, test.vector)
+
+			if encoded := EncodeHeader(&header); !bytes.Equal(encoded, vector) {
+				t.Fatalf("encoded to %x, want %x", encoded, vector)
+			}
+			if hash := sha256.Sum256(vector); !bytes.Equal(header.Hash(), hash[:]) {
+				t.Fatalf("hash is %x, want the sha256 of the encoding %x", header.Hash(), hash)
+			}
+
+			decoded, err := DecodeHeader(vector)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(decoded, header) {
+				t.Fatalf("decoded to %+v, want %+v", decoded, header)
+			}
+		})
+	}
+}
+
+
+func TestMerkleProofVector(t *testing.T) {
+	proof := MerkleProof{[]byte{0x01}, []byte{0x02, 0x03}, 5, [][]byte{{0x04}, {0x05, 0x06}}}
+	vector := unhex(t, `01 0000000101 000000020203 0000000000000005
+		00000002 0000000104 000000020506`)
+
+	if encoded := EncodeMerkleProof(&proof); !bytes.Equal(encoded, vector) {
+		t.Fatalf("encoded to %x, want %x", encoded, vector)
+	}
+
+	decoded, err := DecodeMerkleProof(vector)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(decoded, proof) {
+		t.Fatalf("decoded to %+v, want %+v", decoded, proof)
+	}
+}
+
+
+func TestBlockRoundTrip(t *testing.T) {
+	chain, miner := newTestChain(t, testParams())
+	address := string(miner.Address())
+	genesis := tipBlock(t, chain)
+	pay := payTo(t, chain, miner, genesis.Transactions[0], 0, output(t, address, 20))
+	block := mineOn(t, chain, genesis, address, pay)
+
+	// empty and nil slices encode alike, so the blocks are compared encoded
+	encoded := EncodeBlock(block)
+	decoded, err := DecodeBlock(encoded)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(EncodeBlock(&decoded), encoded) {
+		t.Fatalf("decoded to %+v, want %+v", decoded, *block)
+	}
+	if !bytes.Equal(decoded.BlockHeader.Hash(), block.Hash) || !bytes.Equal(decoded.HashTransactions(), block.MerkleRoot) {
+		t.Fatal("decoded block does not hash like the one encoded")
+	}
+
+	stored, err := chain.GetBlock(block.Hash)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(EncodeBlock(&stored), encoded) {
+		t.Fatal("stored block differs from the one added")
+	}
+}
+
+
+func TestDecodeMalformed(t *testing.T) {
+	chain, miner := newTestChain(t, testParams())
+	block := mineOn(t, chain, tipBlock(t, chain), string(miner.Address()))
+	encoded := EncodeBlock(block)
+
+	tests := []struct {
+		name						string
+		data						[]byte
+	}{
+		{"empty", nil},
+		{"truncated", encoded[:len(encoded)-1]},
+		{"trailing", append(append([]byte{}, encoded...), 0x00)},
+		{"format", append([]byte{0x07}, encoded[1:]...)},
+		// a count far beyond the data must not be allocated
+		{"count", unhex(t, "01 0000000000000001 00000000 00000000 0000000000000000 00000000 0000000000000000 0000000000000000 00000000 ffffffff")},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if _, err := DecodeBlock(test.data); !errors.Is(err, ErrEncoding) {
+				t.Fatalf("decoding gave %v, want ErrEncoding", err)
+			}
+		})
+	}
+}
+
+
+func TestLegacyBlocks(t *testing.T) {
+	chain, miner := newTestChain(t, testParams())
+	block := mineOn(t, chain, tipBlock(t, chain), string(miner.Address()))
+
+	var buffer bytes.Buffer
+	if err := gob.NewEncoder(&buffer).Encode(block); err != nil {
+		t.Fatal(err)
+	}
+
+	// peers have to send the encoding, the database may still hold gob
+	if _, err := DecodeBlock(buffer.Bytes()); !errors.Is(err, ErrEncoding) {
+		t.Fatalf("decoding gob from a peer gave %v, want ErrEncoding", err)
+	}
+
+	stored, err := Deserialize(buffer.Bytes())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(stored.Hash, block.Hash) || len(stored.Transactions) != 1 {
+		t.Fatalf("read back %x with %d transactions", stored.Hash, len(stored.Transactions))
+	}
+}
@@ -0,0 +1,86 @@
+package blockchain
+
+import (
+	"context"
+	"math/big"
+)
+
+// Engine is the consensus scheme a chain is built with: how a header is
+// sealed, how a seal is checked and how much a sealed header adds to the
+// weight of its branch. The branch with the most weight is the active chain.
+type Engine interface {
+	// Prepare fills in the consensus fields of a header whose PrevHash and
+	// Height are set.
+	Prepare(chain ChainReader, header *BlockHeader) error
+	// Seal makes a prepared header valid, it stops with ctx.Err() when ctx is
+	// cancelled.
+	Seal(ctx context.Context, header *BlockHeader) error
+	VerifySeal(chain ChainReader, header *BlockHeader) error
+	// CalcDifficulty returns the Bits of the header after parent, parent is
+	// nil for the genesis header.
+	CalcDifficulty(chain ChainReader, parent *BlockHeader) (uint32, error)
+	Weight(header *BlockHeader) *big.Int
+}
+
+// ChainReader is the part of a chain an engine may look at.
+type ChainReader interface {
+	GetBlockHeader(blockHash []byte) (BlockHeader, error)
+}
+
+// PowEngine seals headers with sha256 proof of work.
+type PowEngine struct {
+	Params						*ChainParams
+	Miner						MinerConfig
+}
+
+
+func NewPowEngine(params *ChainParams, miner MinerConfig) *PowEngine {
+	return &PowEngine{params, miner}
+}
+
+
+func (engine *PowEngine) Prepare(chain ChainReader, header *BlockHeader) error {
+	var parent *BlockHeader
+
+	if len(header.PrevHash) > 0 {
+		prev, err := chain.GetBlockHeader(header.PrevHash)
+		if err != nil {
+			return err
+		}
+		parent = &prev
+	}
+
+	bits, err := engine.CalcDifficulty(chain, parent)
+	if err != nil {
+		return err
+	}
+	header.Bits = bits
+
+	return nil
+}
+
+
+func (engine *PowEngine) Seal(ctx context.Context, header *BlockHeader) error {
+	nonce, _, err := NewProof(header).Run(ctx, engine.Miner)
+	if err != nil {
+		return err
+	}
+	header.Nonce = nonce
+
+	return nil
+}
+
+
+func (engine *PowEngine) VerifySeal(chain ChainReader, header *BlockHeader) error {
+	if !NewProof(header).Validate() {
+		return reject(header.Hash(), RejectProofOfWork, "hash is above the target")
+	}
+
+	return nil
+}
+
+
+func (engine *PowEngine) Weight(header *BlockHeader) *big.Int {
+	return NewProof(header).Work()
+}
+
@@ -0,0 +1,61 @@
+package blockchain
+
+import (
+	"errors"
+	"tensor/lib/storage"
+)
+
+var (
+	ErrNotFound = errors.New("not found")
+	ErrInvalidBlock = errors.New("invalid block")
+	ErrInvalidTransaction = errors.New("invalid transaction")
+	ErrInsufficientFunds = errors.New("not enough funds")
+	ErrDBClosed = errors.New("database is closed")
+	ErrChainExists = errors.New("blockchain already exists")
+	ErrNoChain = errors.New("no existing blockchain found")
+	ErrInvalidProof = errors.New("invalid merkle proof")
+	ErrBlockPruned = errors.New("block has been pruned")
+	ErrInvalidAddress = errors.New("invalid address")
+)
+
+
+// dbError translates storage errors into the errors of this package.
+func dbError(err error) error {
+	switch {
+		case errors.Is(err, storage.ErrNotFound):
+			return ErrNotFound
+		case errors.Is(err, storage.ErrClosed):
+			return ErrDBClosed
+	}
+
+	return err
+}
+
+
+func (chain *BlockChain) view(fn func(txn storage.Txn) error) error {
+	if chain.closed {
+		return ErrDBClosed
+	}
+
+	return dbError(chain.Database.View(fn))
+}
+
+
+func (chain *BlockChain) update(fn func(txn storage.Txn) error) error {
+	if chain.closed {
+		return ErrDBClosed
+	}
+
+	return dbError(chain.Database.Update(fn))
+}
+
+
+func (chain *BlockChain) Close() error {
+	if chain.closed {
+		return ErrDBClosed
+	}
+
+	chain.closed = true
+
+	return chain.Database.Close()
+}
@@ -0,0 +1,241 @@
+package blockchain
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+
+	"tensor/lib/storage"
+	"tensor/lib/wallet"
+)
+
+// testClock is a Clock the tests move by hand.
+type testClock struct {
+	mutex						sync.Mutex
+	now							time.Time
+}
+
+
+func (clock *testClock) Now() time.Time {
+	clock.mutex.Lock()
+	defer clock.mutex.Unlock()
+
+	return clock.now
+}
+
+
+// catchUp moves the clock to timestamp if it is behind it.
+func (clock *testClock) catchUp(timestamp int64) {
+	clock.mutex.Lock()
+	defer clock.mutex.Unlock()
+
+	if clock.now.Unix() < timestamp {
+		clock.now = time.Unix(timestamp, 0)
+	}
+}
+
+
+// testParams are the default parameters with the easiest target and no
+// retargeting, so blocks seal in a few hundred hashes.
+func testParams() *ChainParams {
+	params := DefaultParams
+	params.GenesisBits = BigToCompact(params.PowLimit)
+	params.RetargetInterval = 1000
+	params.CoinbaseMaturity = 1
+
+	return &params
+}
+
+
+// newTestChain starts a proof of work chain in a memory store whose genesis
+// pays the returned wallet.
+func newTestChain(t *testing.T, params *ChainParams) (*BlockChain, *wallet.Wallet) {
+	t.Helper()
+
+	miner := wallet.MakeWallet()
+	chain := startChain(t, params, NewPowEngine(params, MinerConfig{Workers: 1}), string(miner.Address()))
+
+	return chain, miner
+}
+
+
+func startChain(t *testing.T, params *ChainParams, engine Engine, address string) *BlockChain {
+	t.Helper()
+
+	chain, err := CreateBlockChain(storage.NewMemory(), engine, address)
+	if err != nil {
+		t.Fatal(err)
+	}
+	useTestSettings(t, chain, params)
+
+	return chain
+}
+
+
+// useTestSettings points chain at params and a test clock set to the time of
+// its tip.
+func useTestSettings(t *testing.T, chain *BlockChain, params *ChainParams) {
+	t.Helper()
+
+	chain.Params = params
+	chain.Clock = &testClock{now: time.Unix(tipBlock(t, chain).TimeStamp, 0)}
+}
+
+
+func tipBlock(t *testing.T, chain *BlockChain) *Block {
+	t.Helper()
+
+	block, err := chain.GetBlock(chain.Tip())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return &block
+}
+
+
+// sealBlock seals txs on top of parent, 30 seconds after it. edit, if set,
+// changes the prepared header before it is sealed.
+func sealBlock(t *testing.T, chain *BlockChain, parent *Block, txs []*Transaction, edit func(header *BlockHeader)) *Block {
+	t.Helper()
+
+	return sealBy(t, chain, chain.Engine, parent, txs, edit)
+}
+
+
+// sealBy is sealBlock with another engine than the one of chain.
+func sealBy(t *testing.T, chain *BlockChain, engine Engine, parent *Block, txs []*Transaction, edit func(header *BlockHeader)) *Block {
+	t.Helper()
+
+	header := BlockHeader{Version: BlockVersion, PrevHash: parent.Hash, TimeStamp: parent.TimeStamp + 30, Height: parent.Height + 1}
+	if err := engine.Prepare(chain, &header); err != nil {
+		t.Fatal(err)
+	}
+
+	block := &Block{header, nil, txs}
+	block.MerkleRoot = block.HashTransactions()
+	if edit != nil {
+		edit(&block.BlockHeader)
+	}
+
+	if err := engine.Seal(context.Background(), &block.BlockHeader); err != nil {
+		t.Fatal(err)
+	}
+	block.Hash = block.BlockHeader.Hash()
+
+	if clock, ok := chain.Clock.(*testClock); ok {
+		clock.catchUp(block.TimeStamp)
+	}
+
+	return block
+}
+
+
+func coinbaseTx(t *testing.T, address string, value int) *Transaction {
+	t.Helper()
+
+	tx, err := CoinbaseTx(address, "", value)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return tx
+}
+
+
+// mineOn adds a block on top of parent holding a coinbase to address and txs,
+// which pay no fees.
+func mineOn(t *testing.T, chain *BlockChain, parent *Block, address string, txs ...*Transaction) *Block {
+	t.Helper()
+
+	coinbase := coinbaseTx(t, address, chain.Params.BlockSubsidy(parent.Height+1))
+	block := sealBlock(t, chain, parent, append([]*Transaction{coinbase}, txs...), nil)
+
+	if err := chain.AddBlock(block); err != nil {
+		t.Fatal(err)
+	}
+
+	return block
+}
+
+
+// output locks value to address.
+func output(t *testing.T, address string, value int) TxOutput {
+	t.Helper()
+
+	out, err := NewTxOutput(value, address)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return *out
+}
+
+
+// payTo spends output out of prev, locked to from, and signs the spend.
+func payTo(t *testing.T, chain *BlockChain, from *wallet.Wallet, prev *Transaction, out int, outputs ...TxOutput) *Transaction {
+	t.Helper()
+
+	tx := &Transaction{nil, []TxInput{{prev.ID, out, nil, from.PublicKey}}, outputs}
+	tx.ID = tx.Hash()
+
+	if err := chain.SignTransaction(tx, from.PrivateKey); err != nil {
+		t.Fatal(err)
+	}
+
+	return tx
+}
+
+
+// storedUTXOs reads the UTXO set as it is kept in the database.
+func storedUTXOs(t *testing.T, chain *BlockChain) map[Outpoint]UTXO {
+	t.Helper()
+
+	utxos := make(map[Outpoint]UTXO)
+
+	err := chain.view(func(txn storage.Txn) error {
+		return txn.Iterate(utxoprefix, func(key, value []byte) error {
+			utxo, err := DeserializeUTXO(value)
+			if err != nil {
+				return err
+			}
+			txID, out := parseUTXOKey(key)
+			utxos[Outpoint{txID, out}] = utxo
+			return nil
+		})
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return utxos
+}
+
+
+// checkUTXOs compares the stored UTXO set with one rebuilt from the blocks.
+func checkUTXOs(t *testing.T, chain *BlockChain) {
+	t.Helper()
+
+	rebuilt, err := chain.FindUTXO()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if stored := storedUTXOs(t, chain); !reflect.DeepEqual(stored, rebuilt) {
+		t.Fatalf("stored UTXO set has %d outputs, the blocks leave %d unspent", len(stored), len(rebuilt))
+	}
+}
+
+
+// rejectCode returns the code err was rejected with, 0 for no BlockError.
+func rejectCode(err error) RejectCode {
+	var blockErr *BlockError
+	if errors.As(err, &blockErr) {
+		return blockErr.Code
+	}
+
+	return 0
+}
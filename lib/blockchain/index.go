@@ -0,0 +1,541 @@
+package blockchain
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/gob"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"tensor/lib/storage"
+	"tensor/lib/wallet"
+)
+
+var (
+	heightprefix = []byte("height-")
+	txprefix = []byte("tx-")
+	txIndexKey = []byte("txindex")
+	addrprefix = []byte("addr-")
+	addrIndexKey = []byte("addrindex")
+)
+
+type TxLocation struct {
+	BlockHash						[]byte
+	Index							int
+}
+
+// AddressTx is what one transaction did to the outputs locked to an address.
+type AddressTx struct {
+	TxID							[]byte
+	BlockHash						[]byte
+	Height							int
+	Received						int
+	Sent							int
+}
+
+
+func heightKey(height int) []byte {
+	key := make([]byte, len(heightprefix)+8)
+	copy(key, heightprefix)
+	binary.BigEndian.PutUint64(key[len(heightprefix):], uint64(height))
+
+	return key
+}
+
+
+func txKey(txID []byte) []byte {
+	return append(append([]byte{}, txprefix...), txID...)
+}
+
+
+func (location TxLocation) Serialize() []byte {
+	return encodeLegacy(location)
+}
+
+
+func DeserializeTxLocation(data []byte) (TxLocation, error) {
+	var location TxLocation
+	err := gob.NewDecoder(bytes.NewReader(data)).Decode(&location)
+	return location, err
+}
+
+
+// connectBlock makes block, whose parent is the tip in txn, the new tip: its
+// outputs, height and index entries are written in txn.
+func (chain *BlockChain) connectBlock(txn storage.Txn, block *Block) error {
+	undo, err := updateCoins(txn, block)
+	if err != nil {
+		return err
+	}
+
+	if err := txn.Put(heightKey(block.Height), block.Hash); err != nil {
+		return err
+	}
+	if chain.TxIndex {
+		if err := indexTransactions(txn, block); err != nil {
+			return err
+		}
+	}
+	if chain.AddrIndex {
+		entries, err := addressHistory(block, undoOutputs(undo))
+		if err != nil {
+			return err
+		}
+		if err := indexAddresses(txn, entries); err != nil {
+			return err
+		}
+	}
+
+	return txn.Put([]byte("lh"), block.Hash)
+}
+
+
+// disconnectBlock makes the parent of block, the tip in txn, the new tip.
+func (chain *BlockChain) disconnectBlock(txn storage.Txn, block *Block) error {
+	if chain.AddrIndex {
+		undo, err := getUndo(txn, block)
+		if err != nil {
+			return err
+		}
+		entries, err := addressHistory(block, undoOutputs(undo))
+		if err != nil {
+			return err
+		}
+		for key := range entries {
+			if err := txn.Delete([]byte(key)); err != nil {
+				return err
+			}
+		}
+	}
+
+	if err := revertCoins(txn, block); err != nil {
+		return err
+	}
+
+	if err := txn.Delete(heightKey(block.Height)); err != nil {
+		return err
+	}
+	if chain.TxIndex {
+		for _, tx := range block.Transactions {
+			if err := txn.Delete(txKey(tx.ID)); err != nil {
+				return err
+			}
+		}
+	}
+
+	return txn.Put([]byte("lh"), block.PrevHash)
+}
+
+
+func (chain *BlockChain) GetBlockHash(height int) ([]byte, error) {
+	var hash []byte
+
+	err := chain.view(func(txn storage.Txn) error {
+		var err error
+		hash, err = txn.Get(heightKey(height))
+		return err
+	})
+	if err != nil {
+		return nil, fmt.Errorf("block at height %d: %w", height, err)
+	}
+
+	return hash, nil
+}
+
+
+func (chain *BlockChain) GetBlockByHeight(height int) (Block, error) {
+	hash, err := chain.GetBlockHash(height)
+	if err != nil {
+		return Block{}, err
+	}
+
+	return chain.GetBlock(hash)
+}
+
+
+// ReindexHeights rebuilds the height index of the active chain, for chains
+// created before the index existed.
+func (chain *BlockChain) ReindexHeights() error {
+	iter := chain.Iterator()
+
+	for {
+		block, err := iter.Next()
+		if err != nil {
+			return err
+		}
+
+		err = chain.update(func(txn storage.Txn) error {
+			return txn.Put(heightKey(block.Height), block.Hash)
+		})
+		if err != nil {
+			return err
+		}
+
+		if len(block.PrevHash) == 0 {
+			break
+		}
+	}
+
+	return nil
+}
+
+
+func (chain *BlockChain) heightIndexed() (bool, error) {
+	height, err := chain.GetBestHeight()
+	if err != nil {
+		return false, err
+	}
+
+	hash, err := chain.GetBlockHash(height)
+	if errors.Is(err, ErrNotFound) {
+		return false, nil
+	}
+
+	return err == nil && bytes.Equal(hash, chain.Tip()), err
+}
+
+
+func indexTransactions(txn storage.Txn, block *Block) error {
+	for index, tx := range block.Transactions {
+		location := TxLocation{block.Hash, index}
+		if err := txn.Put(txKey(tx.ID), location.Serialize()); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+
+func txIndexEnabled(txn storage.Txn) bool {
+	_, err := txn.Get(txIndexKey)
+
+	return err == nil
+}
+
+
+// ReindexTransactions builds the transaction index from the active chain and
+// turns it on, from then on it is kept up to date as blocks are connected.
+func (chain *BlockChain) ReindexTransactions() (int, error) {
+	count := 0
+
+	if chain.PruneDepth > 0 {
+		return 0, fmt.Errorf("reindexing transactions needs every block: %w", ErrBlockPruned)
+	}
+
+	if err := chain.DeleteByPrefix(txprefix); err != nil {
+		return 0, err
+	}
+
+	iter := chain.Iterator()
+
+	for {
+		block, err := iter.Next()
+		if err != nil {
+			return count, err
+		}
+
+		err = chain.update(func(txn storage.Txn) error {
+			return indexTransactions(txn, block)
+		})
+		if err != nil {
+			return count, err
+		}
+		count += len(block.Transactions)
+
+		if len(block.PrevHash) == 0 {
+			break
+		}
+	}
+
+	err := chain.update(func(txn storage.Txn) error {
+		return txn.Put(txIndexKey, []byte{1})
+	})
+	if err != nil {
+		return count, err
+	}
+
+	chain.TxIndex = true
+
+	return count, nil
+}
+
+
+// findIndexedTransaction looks a transaction up in the transaction index.
+func (chain *BlockChain) findIndexedTransaction(ID []byte) (Transaction, int, error) {
+	var location TxLocation
+
+	err := chain.view(func(txn storage.Txn) error {
+		value, err := txn.Get(txKey(ID))
+		if err != nil {
+			return err
+		}
+
+		location, err = DeserializeTxLocation(value)
+		return err
+	})
+	if err != nil {
+		return Transaction{}, 0, fmt.Errorf("transaction %x: %w", ID, err)
+	}
+
+	block, err := chain.GetBlock(location.BlockHash)
+	if errors.Is(err, ErrBlockPruned) {
+		return chain.unspentTransaction(ID)
+	}
+	if err != nil {
+		return Transaction{}, 0, err
+	}
+
+	if location.Index >= len(block.Transactions) {
+		return Transaction{}, 0, fmt.Errorf("transaction index points past block %x", block.Hash)
+	}
+
+	return *block.Transactions[location.Index], block.Height, nil
+}
+
+
+func addressKey(pubKeyHash []byte, height, position int) []byte {
+	key := append(append([]byte{}, addrprefix...), pubKeyHash...)
+	key = append(key, make([]byte, 12)...)
+	binary.BigEndian.PutUint64(key[len(key)-12:], uint64(height))
+	binary.BigEndian.PutUint32(key[len(key)-4:], uint32(position))
+
+	return key
+}
+
+
+func (entry AddressTx) Serialize() []byte {
+	return encodeLegacy(entry)
+}
+
+
+func DeserializeAddressTx(data []byte) (AddressTx, error) {
+	var entry AddressTx
+	err := gob.NewDecoder(bytes.NewReader(data)).Decode(&entry)
+	return entry, err
+}
+
+
+// undoOutputs looks the outputs a block spent up in its undo record, for
+// addressHistory.
+func undoOutputs(undo BlockUndo) func(txIndex, inputIndex int) (TxOutput, error) {
+	return func(txIndex, inputIndex int) (TxOutput, error) {
+		if txIndex >= len(undo.Spent) || inputIndex >= len(undo.Spent[txIndex]) {
+			return TxOutput{}, fmt.Errorf("undo data has no input %d of transaction %d: %w", inputIndex, txIndex, ErrNotFound)
+		}
+
+		return undo.Spent[txIndex][inputIndex].Output, nil
+	}
+}
+
+
+// chainOutputs looks the outputs a block spent up in the block itself and the
+// active chain, for addressHistory.
+func (chain *BlockChain) chainOutputs(block *Block) func(txIndex, inputIndex int) (TxOutput, error) {
+	blockTxs := make(map[string]*Transaction)
+	for _, tx := range block.Transactions {
+		blockTxs[hex.EncodeToString(tx.ID)] = tx
+	}
+
+	return func(txIndex, inputIndex int) (TxOutput, error) {
+		input := block.Transactions[txIndex].Inputs[inputIndex]
+
+		prevTx, ok := blockTxs[hex.EncodeToString(input.ID)]
+		if !ok {
+			found, err := chain.FindTransaction(input.ID)
+			if err != nil {
+				return TxOutput{}, err
+			}
+			prevTx = &found
+		}
+		if input.Out < 0 || input.Out >= len(prevTx.Outputs) {
+			return TxOutput{}, fmt.Errorf("transaction %x spends missing output %x:%d: %w", block.Transactions[txIndex].ID, input.ID, input.Out, ErrNotFound)
+		}
+
+		return prevTx.Outputs[input.Out], nil
+	}
+}
+
+
+// addressHistory returns the address index entries of a block, keyed by their
+// database key. spentOutput returns the output an input of the block spends.
+func addressHistory(block *Block, spentOutput func(txIndex, inputIndex int) (TxOutput, error)) (map[string]*AddressTx, error) {
+	entries := make(map[string]*AddressTx)
+
+	entry := func(pubKeyHash []byte, position int, tx *Transaction) *AddressTx {
+		key := string(addressKey(pubKeyHash, block.Height, position))
+		if entries[key] == nil {
+			entries[key] = &AddressTx{TxID: tx.ID, BlockHash: block.Hash, Height: block.Height}
+		}
+		return entries[key]
+	}
+
+	for position, tx := range block.Transactions {
+		if !tx.IsCoinbase() {
+			for inputIndex, input := range tx.Inputs {
+				output, err := spentOutput(position, inputIndex)
+				if err != nil {
+					return nil, err
+				}
+
+				entry(wallet.PubKeyHash(input.PubKey), position, tx).Sent += output.Value
+			}
+		}
+
+		for _, output := range tx.Outputs {
+			entry(output.PubKeyHash, position, tx).Received += output.Value
+		}
+	}
+
+	return entries, nil
+}
+
+
+func indexAddresses(txn storage.Txn, entries map[string]*AddressTx) error {
+	for key, entry := range entries {
+		if err := txn.Put([]byte(key), entry.Serialize()); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+
+func addrIndexEnabled(txn storage.Txn) bool {
+	_, err := txn.Get(addrIndexKey)
+
+	return err == nil
+}
+
+
+// ReindexAddresses builds the address index from the active chain and turns
+// it on, from then on it is kept up to date as blocks are connected.
+func (chain *BlockChain) ReindexAddresses() (int, error) {
+	count := 0
+
+	if chain.PruneDepth > 0 {
+		return 0, fmt.Errorf("reindexing addresses needs every block: %w", ErrBlockPruned)
+	}
+
+	if err := chain.DeleteByPrefix(addrprefix); err != nil {
+		return 0, err
+	}
+
+	iter := chain.Iterator()
+
+	for {
+		block, err := iter.Next()
+		if err != nil {
+			return count, err
+		}
+
+		entries, err := addressHistory(block, chain.chainOutputs(block))
+		if err != nil {
+			return count, err
+		}
+
+		err = chain.update(func(txn storage.Txn) error {
+			return indexAddresses(txn, entries)
+		})
+		if err != nil {
+			return count, err
+		}
+		count += len(entries)
+
+		if len(block.PrevHash) == 0 {
+			break
+		}
+	}
+
+	err := chain.update(func(txn storage.Txn) error {
+		return txn.Put(addrIndexKey, []byte{1})
+	})
+	if err != nil {
+		return count, err
+	}
+
+	chain.AddrIndex = true
+
+	return count, nil
+}
+
+
+// AddressHistory pages through the transactions that credited or debited
+// pubKeyHash on the active chain, oldest first.
+func (chain *BlockChain) AddressHistory(pubKeyHash []byte, offset, limit int) ([]AddressTx, error) {
+	var history []AddressTx
+
+	if !chain.AddrIndex {
+		return nil, errors.New("address index is not enabled, run reindex-addr")
+	}
+
+	prefix := append(append([]byte{}, addrprefix...), pubKeyHash...)
+
+	if limit <= 0 {
+		return nil, nil
+	}
+
+	err := chain.view(func(txn storage.Txn) error {
+		skipped := 0
+
+		return txn.Iterate(prefix, func(key, value []byte) error {
+			if skipped < offset {
+				skipped++
+				return nil
+			}
+
+			entry, err := DeserializeAddressTx(value)
+			if err != nil {
+				return err
+			}
+			history = append(history, entry)
+
+			if len(history) == limit {
+				return storage.ErrStop
+			}
+			return nil
+		})
+	})
+
+	return history, err
+}
+
+
+func (chain *BlockChain) DeleteByPrefix(prefix []byte) error {
+	var keys [][]byte
+
+	err := chain.view(func(txn storage.Txn) error {
+		return txn.Iterate(prefix, func(key, value []byte) error {
+			keys = append(keys, key)
+			return nil
+		})
+	})
+	if err != nil {
+		return err
+	}
+
+	collectionSize := 100000
+
+	for len(keys) > 0 {
+		batch := keys
+		if len(batch) > collectionSize {
+			batch = batch[:collectionSize]
+		}
+		keys = keys[len(batch):]
+
+		err := chain.update(func(txn storage.Txn) error {
+			for _, key := range batch {
+				if err := txn.Delete(key); err != nil {
+					return err
+				}
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
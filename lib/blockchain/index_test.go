@@ -0,0 +1,68 @@
+package blockchain
+
+import (
+	"bytes"
+	"testing"
+
+	"tensor/lib/wallet"
+)
+
+func TestAddressHistoryPaging(t *testing.T) {
+	chain, miner := newTestChain(t, testParams())
+	if _, err := chain.AddressHistory(wallet.PubKeyHash(miner.PublicKey), 0, 10); err == nil {
+		t.Fatal("history was read without the address index")
+	}
+	if _, err := chain.ReindexAddresses(); err != nil {
+		t.Fatal(err)
+	}
+
+	payee := wallet.MakeWallet()
+	pubKeyHash := wallet.PubKeyHash(payee.PublicKey)
+
+	parent := tipBlock(t, chain)
+	var paid []*Block
+	for height := 1; height <= 5; height++ {
+		parent = mineOn(t, chain, parent, string(payee.Address()))
+		paid = append(paid, parent)
+	}
+	spend := payTo(t, chain, payee, paid[0].Transactions[0], 0, output(t, string(miner.Address()), 20))
+	mineOn(t, chain, parent, string(miner.Address()), spend)
+
+	tests := []struct {
+		offset						int
+		limit						int
+		heights						[]int
+	}{
+		{0, 2, []int{1, 2}},
+		{2, 2, []int{3, 4}},
+		{4, 10, []int{5, 6}},
+		{6, 10, nil},
+		{0, 0, nil},
+	}
+
+	for _, test := range tests {
+		history, err := chain.AddressHistory(pubKeyHash, test.offset, test.limit)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(history) != len(test.heights) {
+			t.Fatalf("page %d+%d has %d entries, want %d", test.offset, test.limit, len(history), len(test.heights))
+		}
+		for i, entry := range history {
+			if entry.Height != test.heights[i] {
+				t.Fatalf("page %d+%d entry %d is at height %d, want %d", test.offset, test.limit, i, entry.Height, test.heights[i])
+			}
+		}
+	}
+
+	history, err := chain.AddressHistory(pubKeyHash, 4, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if received := history[0]; received.Received != 20 || received.Sent != 0 || !bytes.Equal(received.TxID, paid[4].Transactions[0].ID) {
+		t.Fatalf("coinbase entry is %+v", received)
+	}
+	if sent := history[1]; sent.Received != 0 || sent.Sent != 20 || !bytes.Equal(sent.TxID, spend.ID) {
+		t.Fatalf("spend entry is %+v", sent)
+	}
+}
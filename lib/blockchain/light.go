@@ -0,0 +1,473 @@
+package blockchain
+
+import (
+	"bytes"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"tensor/lib/storage"
+)
+
+// A light chain keeps only the headers of the chain it follows. The
+// transactions it cares about are stored with the merkle proof that puts them
+// in one of those headers.
+
+const (
+	lightDBPath = "./DB/light_%s"
+	// MaxHeaders is the most headers sent in one reply to getheaders.
+	MaxHeaders = 2000
+)
+
+var (
+	lightKey = []byte("light")
+	proofprefix = []byte("proof-")
+)
+
+
+func proofKey(txID []byte) []byte {
+	return append(append([]byte{}, proofprefix...), txID...)
+}
+
+
+// OpenLightChain opens the header chain of nodeID, creating an empty one the
+// first time. Its genesis is the first header it is given.
+func OpenLightChain(nodeID string, engine Engine) (*BlockChain, error) {
+	store, err := storage.OpenBadger(fmt.Sprintf(lightDBPath, nodeID))
+	if err != nil {
+		return nil, fmt.Errorf("opening database: %w", err)
+	}
+
+	chain, err := LoadLightChain(store, engine)
+	if err != nil {
+		store.Close()
+		return nil, err
+	}
+
+	return chain, nil
+}
+
+
+// LoadLightChain opens the header chain kept in store.
+func LoadLightChain(store storage.Store, engine Engine) (*BlockChain, error) {
+	var lastHash []byte
+
+	err := store.Update(func(txn storage.Txn) error {
+		lastHash, _ = txn.Get([]byte("lh"))
+
+		if _, err := txn.Get(lightKey); errors.Is(err, storage.ErrNotFound) {
+			if lastHash != nil {
+				return fmt.Errorf("store holds a full chain")
+			}
+			return txn.Put(lightKey, []byte{1})
+		}else {
+			return err
+		}
+	})
+	if err != nil {
+		return nil, fmt.Errorf("opening light chain: %w", dbError(err))
+	}
+
+	return &BlockChain{LastHash: lastHash, Database: store, Params: &DefaultParams, Engine: engine, Clock: SystemClock, Light: true}, nil
+}
+
+
+// HeaderHeight is the height of the best header, -1 while a light chain has
+// none yet.
+func (chain *BlockChain) HeaderHeight() (int, error) {
+	if len(chain.Tip()) == 0 {
+		return -1, nil
+	}
+
+	return chain.GetBestHeight()
+}
+
+
+// Locator lists hashes of the active chain from the tip back to genesis,
+// dense near the tip and doubling the gap further down.
+func (chain *BlockChain) Locator() ([][]byte, error) {
+	var locator [][]byte
+
+	// headers towards the checkpoint continue from the end of their run
+	chain.mutex.Lock()
+	if run := chain.checkpointHeaders; len(run) > 0 {
+		locator = append(locator, run[len(run)-1].Hash())
+	}
+	chain.mutex.Unlock()
+
+	height, err := chain.HeaderHeight()
+	if err != nil {
+		return nil, err
+	}
+
+	step := 1
+	for height >= 0 {
+		hash, err := chain.GetBlockHash(height)
+		if err != nil {
+			return nil, err
+		}
+		locator = append(locator, hash)
+
+		if height == 0 {
+			break
+		}
+		if len(locator) >= 10 {
+			step *= 2
+		}
+		height -= step
+		if height < 0 {
+			height = 0
+		}
+	}
+
+	return locator, nil
+}
+
+
+// HeadersAfter returns up to max headers of the active chain following the
+// first locator hash found on it, or from genesis if none is.
+func (chain *BlockChain) HeadersAfter(locator [][]byte, max int) ([]*BlockHeader, error) {
+	var headers []*BlockHeader
+
+	start := 0
+	for _, hash := range locator {
+		header, err := chain.GetBlockHeader(hash)
+		if errors.Is(err, ErrNotFound) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		active, err := chain.GetBlockHash(header.Height)
+		if err != nil && !errors.Is(err, ErrNotFound) {
+			return nil, err
+		}
+		if bytes.Equal(active, hash) {
+			start = header.Height + 1
+			break
+		}
+	}
+
+	best, err := chain.GetBestHeight()
+	if err != nil {
+		return nil, err
+	}
+
+	for height := start; height <= best && len(headers) < max; height++ {
+		hash, err := chain.GetBlockHash(height)
+		if err != nil {
+			return nil, err
+		}
+		header, err := chain.GetBlockHeader(hash)
+		if err != nil {
+			return nil, err
+		}
+		headers = append(headers, &header)
+	}
+
+	return headers, nil
+}
+
+
+func (chain *BlockChain) validateGenesisHeader(header *BlockHeader) error {
+	hash := header.Hash()
+
+	if err := chain.Engine.VerifySeal(chain, header); err != nil {
+		return err
+	}
+	if len(header.PrevHash) != 0 || header.Height != 0 {
+		return reject(hash, RejectUnknownParent, "first header is not a genesis header")
+	}
+	if len(chain.Params.GenesisHash) > 0 && !bytes.Equal(hash, chain.Params.GenesisHash) {
+		return reject(hash, RejectCheckpoint, "genesis is %x", chain.Params.GenesisHash)
+	}
+	if err := chain.checkCheckpoints(header); err != nil {
+		return err
+	}
+	if err := chain.checkTimestamp(header, nil); err != nil {
+		return err
+	}
+
+	bits, err := chain.CalcNextBits(nil)
+	if err != nil {
+		return err
+	}
+	if header.Bits != bits {
+		return reject(hash, RejectBadDifficulty, "bits %08x do not match genesis bits %08x", header.Bits, bits)
+	}
+
+	return nil
+}
+
+
+// AddHeader validates and stores a header on a light chain, moving the tip if
+// its branch has the most work. The first header added has to be the genesis
+// pinned in Params.GenesisHash.
+func (chain *BlockChain) AddHeader(header *BlockHeader) error {
+	var bestChain bool
+
+	chain.mutex.Lock()
+	defer chain.mutex.Unlock()
+
+	hash := header.Hash()
+	lastHash := chain.Tip()
+
+	if _, err := chain.GetBlockHeader(hash); err == nil {
+		return nil
+	}else if !errors.Is(err, ErrNotFound) {
+		return err
+	}
+
+	if len(lastHash) == 0 {
+		// any peer could hand over a genesis of its own making
+		if len(chain.Params.GenesisHash) == 0 {
+			return fmt.Errorf("header %x: no genesis hash is pinned to check it against", hash)
+		}
+		if err := chain.validateGenesisHeader(header); err != nil {
+			return err
+		}
+	}else if err := chain.ValidateHeader(header); err != nil {
+		return err
+	}
+
+	err := chain.update(func(txn storage.Txn) error {
+		work := chain.Engine.Weight(header)
+		if len(header.PrevHash) > 0 {
+			parentWork, err := chain.chainWork(txn, header.PrevHash)
+			if err != nil {
+				return err
+			}
+			work.Add(work, parentWork)
+		}
+
+		if err := txn.Put(headerKey(hash), header.Serialize()); err != nil {
+			return err
+		}
+		if err := txn.Put(workKey(hash), work.Bytes()); err != nil {
+			return err
+		}
+
+		if len(lastHash) == 0 {
+			bestChain = true
+			return nil
+		}
+
+		bestWork, err := chain.chainWork(txn, lastHash)
+		if err != nil {
+			return err
+		}
+		bestChain = work.Cmp(bestWork) > 0
+
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("storing header %x: %w", hash, err)
+	}
+
+	if bestChain {
+		return chain.reorganizeHeaders(header)
+	}
+
+	return nil
+}
+
+
+// reorganizeHeaders makes newTip the tip of a light chain, pointing the height
+// index at its branch.
+func (chain *BlockChain) reorganizeHeaders(newTip *BlockHeader) error {
+	var attach []*BlockHeader
+
+	for header := newTip; ; {
+		active, err := chain.GetBlockHash(header.Height)
+		if err != nil && !errors.Is(err, ErrNotFound) {
+			return err
+		}
+		if bytes.Equal(active, header.Hash()) {
+			break
+		}
+		attach = append(attach, header)
+
+		if len(header.PrevHash) == 0 {
+			break
+		}
+		parent, err := chain.GetBlockHeader(header.PrevHash)
+		if err != nil {
+			return err
+		}
+		header = &parent
+	}
+
+	oldHeight, err := chain.HeaderHeight()
+	if err != nil {
+		return err
+	}
+
+	newHash := newTip.Hash()
+
+	err = chain.update(func(txn storage.Txn) error {
+		for height := newTip.Height + 1; height <= oldHeight; height++ {
+			if err := txn.Delete(heightKey(height)); err != nil {
+				return err
+			}
+		}
+		for _, header := range attach {
+			if err := txn.Put(heightKey(header.Height), header.Hash()); err != nil {
+				return err
+			}
+		}
+		return txn.Put([]byte("lh"), newHash)
+	})
+	if err != nil {
+		return err
+	}
+
+	chain.setTip(newHash)
+
+	return nil
+}
+
+
+// AddressProofs proves every transaction on the active chain that pays to or
+// spends from pubKeyHash. Peers ask for them unauthenticated, so they are only
+// served from the address index. Transactions in pruned blocks can no longer
+// be proven and are left out.
+func (chain *BlockChain) AddressProofs(pubKeyHash []byte) ([]*MerkleProof, error) {
+	var proofs []*MerkleProof
+
+	if !chain.AddrIndex {
+		return nil, errors.New("proofs are served from the address index, run reindex-addr")
+	}
+
+	for offset := 0; ; offset += 1000 {
+		history, err := chain.AddressHistory(pubKeyHash, offset, 1000)
+		if err != nil {
+			return nil, err
+		}
+
+		for _, entry := range history {
+			block, err := chain.GetBlock(entry.BlockHash)
+			if errors.Is(err, ErrBlockPruned) {
+				continue
+			}
+			if err != nil {
+				return nil, err
+			}
+			proof, err := block.MerkleProof(entry.TxID)
+			if err != nil {
+				return nil, err
+			}
+			proofs = append(proofs, proof)
+		}
+
+		if len(history) < 1000 {
+			return proofs, nil
+		}
+	}
+}
+
+
+// onActiveChain returns the header of blockHash if it is on the active chain.
+func (chain *BlockChain) onActiveChain(blockHash []byte) (*BlockHeader, error) {
+	header, err := chain.GetBlockHeader(blockHash)
+	if err != nil {
+		return nil, err
+	}
+
+	active, err := chain.GetBlockHash(header.Height)
+	if err != nil && !errors.Is(err, ErrNotFound) {
+		return nil, err
+	}
+	if !bytes.Equal(active, blockHash) {
+		return nil, fmt.Errorf("block %x is not on the active chain: %w", blockHash, ErrNotFound)
+	}
+
+	return &header, nil
+}
+
+
+// AddProof checks a proof against the headers of a light chain and keeps the
+// transaction it proves.
+func (chain *BlockChain) AddProof(proof *MerkleProof) (*Transaction, error) {
+	chain.mutex.Lock()
+	defer chain.mutex.Unlock()
+
+	header, err := chain.onActiveChain(proof.BlockHash)
+	if err != nil {
+		return nil, err
+	}
+
+	if !proof.Verify(header.MerkleRoot) {
+		return nil, fmt.Errorf("block %x: %w", proof.BlockHash, ErrInvalidProof)
+	}
+
+	tx, err := proof.Tx()
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidProof, err)
+	}
+	if !bytes.Equal(tx.ID, unsignedHash(&tx)) {
+		return nil, fmt.Errorf("transaction %x: %w", tx.ID, ErrInvalidProof)
+	}
+
+	err = chain.update(func(txn storage.Txn) error {
+		return txn.Put(proofKey(tx.ID), EncodeMerkleProof(proof))
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return &tx, nil
+}
+
+
+// ProvenBalance adds up the outputs locked to pubKeyHash in the proven
+// transactions of the active chain that no other proven transaction spends.
+func (chain *BlockChain) ProvenBalance(pubKeyHash []byte) (int, error) {
+	var txs []Transaction
+
+	err := chain.view(func(txn storage.Txn) error {
+		return txn.Iterate(proofprefix, func(key, value []byte) error {
+			proof, err := DecodeMerkleProof(value)
+			if err != nil {
+				return err
+			}
+			tx, err := proof.Tx()
+			if err != nil {
+				return err
+			}
+
+			header, err := getHeader(txn, proof.BlockHash)
+			if err != nil {
+				return err
+			}
+			active, err := txn.Get(heightKey(header.Height))
+			if err == nil && bytes.Equal(active, proof.BlockHash) {
+				txs = append(txs, tx)
+			}
+			return nil
+		})
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	spent := make(map[Outpoint]bool)
+	for _, tx := range txs {
+		if tx.IsCoinbase() {
+			continue
+		}
+		for _, in := range tx.Inputs {
+			spent[Outpoint{hex.EncodeToString(in.ID), in.Out}] = true
+		}
+	}
+
+	balance := 0
+	for _, tx := range txs {
+		for outIdx, out := range tx.Outputs {
+			if out.IsLockedWithKey(pubKeyHash) && !spent[Outpoint{hex.EncodeToString(tx.ID), outIdx}] {
+				balance += out.Value
+			}
+		}
+	}
+
+	return balance, nil
+}
@@ -0,0 +1,186 @@
+package blockchain
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+	"time"
+
+	"tensor/lib/storage"
+	"tensor/lib/wallet"
+)
+
+// newLightChain opens an empty light chain that follows source and trusts
+// genesisHash.
+func newLightChain(t *testing.T, source *BlockChain, genesisHash []byte) *BlockChain {
+	t.Helper()
+
+	chain, err := LoadLightChain(storage.NewMemory(), source.Engine)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	params := *source.Params
+	params.GenesisHash = genesisHash
+	chain.Params = &params
+	chain.Clock = &testClock{now: time.Unix(tipBlock(t, source).TimeStamp, 0)}
+
+	return chain
+}
+
+
+func TestLightGenesisPin(t *testing.T) {
+	source, miner := newTestChain(t, testParams())
+	genesis := tipBlock(t, source)
+	block1 := mineOn(t, source, genesis, string(miner.Address()))
+
+	// a genesis of another chain, sealed the same way
+	other, _ := newTestChain(t, testParams())
+	otherGenesis := tipBlock(t, other)
+
+	tests := []struct {
+		name						string
+		pin							[]byte
+		header						*BlockHeader
+		code						RejectCode
+	}{
+		{"other genesis", genesis.Hash, &otherGenesis.BlockHeader, RejectCheckpoint},
+		{"other pin", otherGenesis.Hash, &genesis.BlockHeader, RejectCheckpoint},
+		{"not a genesis", genesis.Hash, &block1.BlockHeader, RejectUnknownParent},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			chain := newLightChain(t, source, test.pin)
+			if err := chain.AddHeader(test.header); rejectCode(err) != test.code {
+				t.Fatalf("got %v, want reject code %s", err, test.code)
+			}
+			if height, err := chain.HeaderHeight(); err != nil || height != -1 {
+				t.Fatalf("header height is %d, %v, want -1", height, err)
+			}
+		})
+	}
+
+	unpinned := newLightChain(t, source, nil)
+	if err := unpinned.AddHeader(&genesis.BlockHeader); err == nil {
+		t.Fatal("a genesis was taken without a pinned hash")
+	}
+
+	chain := newLightChain(t, source, genesis.Hash)
+	for height, header := range []*BlockHeader{&genesis.BlockHeader, &block1.BlockHeader} {
+		if err := chain.AddHeader(header); err != nil {
+			t.Fatal(err)
+		}
+		if got, err := chain.HeaderHeight(); err != nil || got != height {
+			t.Fatalf("header height is %d, %v, want %d", got, err, height)
+		}
+	}
+	if !bytes.Equal(chain.Tip(), block1.Hash) {
+		t.Fatalf("tip is %x, want %x", chain.Tip(), block1.Hash)
+	}
+}
+
+
+func TestProvenBalance(t *testing.T) {
+	source, miner := newTestChain(t, testParams())
+	if _, err := source.ReindexAddresses(); err != nil {
+		t.Fatal(err)
+	}
+	address := string(miner.Address())
+	payee := wallet.MakeWallet()
+	pubKeyHash := wallet.PubKeyHash(payee.PublicKey)
+
+	genesis := tipBlock(t, source)
+	block1 := mineOn(t, source, genesis, address)
+	pay := payTo(t, source, miner, genesis.Transactions[0], 0, output(t, string(payee.Address()), 15), output(t, address, 5))
+	block2 := mineOn(t, source, block1, address, pay)
+	spend := payTo(t, source, payee, pay, 0, output(t, address, 5), output(t, string(payee.Address()), 10))
+	block3 := mineOn(t, source, block2, address, spend)
+
+	chain := newLightChain(t, source, genesis.Hash)
+	for _, block := range []*Block{genesis, block1, block2, block3} {
+		if err := chain.AddHeader(&block.BlockHeader); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	proofs, err := source.AddressProofs(pubKeyHash)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(proofs) != 2 {
+		t.Fatalf("%d proofs for the payee, want 2", len(proofs))
+	}
+
+	tampered := *proofs[0]
+	tx, _ := tampered.Tx()
+	tx.Outputs[0].Value = 1000
+	tampered.Transaction = tx.Serialize()
+	if _, err := chain.AddProof(&tampered); !errors.Is(err, ErrInvalidProof) {
+		t.Fatalf("proof of a changed transaction gave %v, want ErrInvalidProof", err)
+	}
+	unknown := *proofs[0]
+	unknown.BlockHash = bytes.Repeat([]byte{0x01}, 32)
+	if _, err := chain.AddProof(&unknown); !errors.Is(err, ErrNotFound) {
+		t.Fatalf("proof from an unknown block gave %v, want ErrNotFound", err)
+	}
+
+	for i, proof := range proofs {
+		proven, err := chain.AddProof(proof)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if want := []*Transaction{pay, spend}[i]; !bytes.Equal(proven.ID, want.ID) {
+			t.Fatalf("proof %d is of %x, want %x", i, proven.ID, want.ID)
+		}
+	}
+
+	// the 15 received were spent, 10 came back as change
+	if balance, err := chain.ProvenBalance(pubKeyHash); err != nil || balance != 10 {
+		t.Fatalf("proven balance is %d, %v, want 10", balance, err)
+	}
+}
+
+
+func TestAddressProofsServed(t *testing.T) {
+	chain, miner := newTestChain(t, testParams())
+	address := string(miner.Address())
+	payee := wallet.MakeWallet()
+	pubKeyHash := wallet.PubKeyHash(payee.PublicKey)
+
+	// walking the chain for every peer that asks is too much work
+	if _, err := chain.AddressProofs(pubKeyHash); err == nil {
+		t.Fatal("proofs were served without the address index")
+	}
+	if _, err := chain.ReindexAddresses(); err != nil {
+		t.Fatal(err)
+	}
+
+	genesis := tipBlock(t, chain)
+	old := payTo(t, chain, miner, genesis.Transactions[0], 0, output(t, string(payee.Address()), 15), output(t, address, 5))
+	parent := mineOn(t, chain, genesis, address, old)
+	recent := payTo(t, chain, miner, old, 1, output(t, string(payee.Address()), 5))
+	for height := 2; height <= MinPruneDepth+1; height++ {
+		if height == MinPruneDepth+1 {
+			parent = mineOn(t, chain, parent, address, recent)
+		}else {
+			parent = mineOn(t, chain, parent, address)
+		}
+	}
+
+	if _, err := chain.EnablePruning(MinPruneDepth); err != nil {
+		t.Fatal(err)
+	}
+
+	// the block paying old is pruned, only recent can still be proven
+	proofs, err := chain.AddressProofs(pubKeyHash)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(proofs) != 1 {
+		t.Fatalf("got %d proofs, want 1", len(proofs))
+	}
+	if proven, err := proofs[0].Tx(); err != nil || !bytes.Equal(proven.ID, recent.ID) {
+		t.Fatalf("proof holds transaction %x, %v, want %x", proven.ID, err, recent.ID)
+	}
+}
@@ -0,0 +1,74 @@
+package blockchain
+
+import (
+	"errors"
+)
+
+const (
+	// room kept for the encoded header, hash and transaction count of a
+	// block, signed headers included
+	blockOverhead = 512
+)
+
+var (
+	ErrBlockFull = errors.New("transaction does not fit in the block")
+)
+
+// BlockBudget keeps track of the room left in a block being assembled.
+type BlockBudget struct {
+	params						*ChainParams
+	size						int
+	sigOps						int
+}
+
+
+// SigOps is the number of signature checks a transaction costs.
+func (tx *Transaction) SigOps() int {
+	if tx.IsCoinbase() {
+		return 0
+	}
+
+	return len(tx.Inputs)
+}
+
+
+// Size is the length of the encoded transaction, prefix included.
+func (tx *Transaction) Size() int {
+	return len(EncodeTransaction(tx)) + 4
+}
+
+
+func NewBlockBudget(params *ChainParams) *BlockBudget {
+	return &BlockBudget{params: params, size: blockOverhead}
+}
+
+
+// Add takes tx into the block if it still fits in both limits.
+func (budget *BlockBudget) Add(tx *Transaction) error {
+	size, sigOps := budget.size+tx.Size(), budget.sigOps+tx.SigOps()
+
+	if size > budget.params.MaxBlockSize || sigOps > budget.params.MaxBlockSigOps {
+		return ErrBlockFull
+	}
+	budget.size, budget.sigOps = size, sigOps
+
+	return nil
+}
+
+
+// checkBlockLimits rejects a block over the size or signature check limits.
+func (chain *BlockChain) checkBlockLimits(block *Block) error {
+	if size := len(EncodeBlock(block)); size > chain.Params.MaxBlockSize {
+		return reject(block.Hash, RejectBlockTooLarge, "block is %d bytes, the limit is %d", size, chain.Params.MaxBlockSize)
+	}
+
+	sigOps := 0
+	for _, tx := range block.Transactions {
+		sigOps += tx.SigOps()
+	}
+	if sigOps > chain.Params.MaxBlockSigOps {
+		return reject(block.Hash, RejectBlockTooLarge, "block needs %d signature checks, the limit is %d", sigOps, chain.Params.MaxBlockSigOps)
+	}
+
+	return nil
+}
@@ -0,0 +1,32 @@
+package blockchain
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+)
+
+func TestBlockBudget(t *testing.T) {
+	params := DefaultParams
+	params.MaxBlockSigOps = 3
+	prevID := bytes.Repeat([]byte{0x01}, 32)
+	tx := &Transaction{nil, []TxInput{{prevID, 0, nil, nil}, {prevID, 1, nil, nil}}, []TxOutput{{1, nil}}}
+
+	budget := NewBlockBudget(&params)
+	if err := budget.Add(tx); err != nil {
+		t.Fatal(err)
+	}
+	if err := budget.Add(tx); !errors.Is(err, ErrBlockFull) {
+		t.Fatalf("going over the signature checks gave %v, want ErrBlockFull", err)
+	}
+
+	params = DefaultParams
+	params.MaxBlockSize = blockOverhead + tx.Size()
+	budget = NewBlockBudget(&params)
+	if err := budget.Add(tx); err != nil {
+		t.Fatal(err)
+	}
+	if err := budget.Add(tx); !errors.Is(err, ErrBlockFull) {
+		t.Fatalf("going over the size gave %v, want ErrBlockFull", err)
+	}
+}
@@ -1,12 +1,14 @@
 package blockchain
 
 import (
+	"bytes"
 	"crypto/sha256"
 )
 
 
 type MarkleTree struct {
 	RootNode 					*MarkleNode
+	levels						[][]MarkleNode
 }
 
 type MarkleNode struct {
@@ -15,6 +17,15 @@ type MarkleNode struct {
 	Data						[]byte
 }
 
+// MerkleProof shows that a transaction is part of a block: hashing the
+// encoded transaction with Hashes, from the leaf up, gives the merkle root.
+type MerkleProof struct {
+	BlockHash					[]byte
+	Transaction					[]byte
+	Index						int
+	Hashes						[][]byte
+}
+
 
 func NewMarkleNode(left, right *MarkleNode, data []byte) *MarkleNode {
 	node := MarkleNode{}
@@ -23,7 +34,7 @@ func NewMarkleNode(left, right *MarkleNode, data []byte) *MarkleNode {
 		hash := sha256.Sum256(data)
 		node.Data = hash[:]
 	}else{
-		previousHashes := append(left.Data, right.Data...)
+		previousHashes := append(append([]byte{}, left.Data...), right.Data...)
 		hash := sha256.Sum256(previousHashes)
 		node.Data = hash[:]
 	}
@@ -36,9 +47,11 @@ func NewMarkleNode(left, right *MarkleNode, data []byte) *MarkleNode {
 
 func NewMarkleTree(data [][]byte) *MarkleTree {
 	var nodes []MarkleNode
+	tree := MarkleTree{}
 
-	if len(data)%2 != 0 {
-		data = append(data, data[len(data)-1])
+	if len(data) == 0 {
+		tree.RootNode = NewMarkleNode(nil, nil, nil)
+		return &tree
 	}
 
 	for _, dat := range data {
@@ -46,7 +59,14 @@ func NewMarkleTree(data [][]byte) *MarkleTree {
 		nodes = append(nodes, *node)
 	}
 
-	for i := 0; i < len(data)/2; i++ {
+	for {
+		// odd levels are padded with a copy of their last node, a single leaf
+		// is paired with itself
+		if len(nodes)%2 != 0 {
+			nodes = append(nodes, nodes[len(nodes)-1])
+		}
+		tree.levels = append(tree.levels, nodes)
+
 		var level []MarkleNode
 
 		for j := 0; j < len(nodes); j += 2 {
@@ -54,9 +74,76 @@ func NewMarkleTree(data [][]byte) *MarkleTree {
 			level = append(level, *node)
 		}
 		nodes =  level
+
+		if len(nodes) == 1 {
+			break
+		}
 	}
 
-	tree := MarkleTree{&nodes[0]}
+	tree.RootNode = &nodes[0]
 
 	return &tree
-}
\ No newline at end of file
+}
+
+
+// Path returns the sibling hashes from the leaf at index up to the root.
+func (tree *MarkleTree) Path(index int) [][]byte {
+	var hashes [][]byte
+
+	for _, level := range tree.levels {
+		hashes = append(hashes, level[index^1].Data)
+		index /= 2
+	}
+
+	return hashes
+}
+
+
+// NewMerkleProof proves that the transaction at index is one of txs.
+func NewMerkleProof(txs []*Transaction, index int) *MerkleProof {
+	var txHashes [][]byte
+
+	for _, tx := range txs {
+		txHashes = append(txHashes, tx.Serialize())
+	}
+
+	tree := NewMarkleTree(txHashes)
+
+	return &MerkleProof{Transaction: txHashes[index], Index: index, Hashes: tree.Path(index)}
+}
+
+
+// Root returns the merkle root the proof leads to.
+func (proof *MerkleProof) Root() []byte {
+	hash := sha256.Sum256(proof.Transaction)
+	node := hash[:]
+	index := proof.Index
+
+	for _, sibling := range proof.Hashes {
+		if index%2 == 0 {
+			hash = sha256.Sum256(append(append([]byte{}, node...), sibling...))
+		}else {
+			hash = sha256.Sum256(append(append([]byte{}, sibling...), node...))
+		}
+		node = hash[:]
+		index /= 2
+	}
+
+	return node
+}
+
+
+// Verify checks the proof against the merkle root of a block header.
+func (proof *MerkleProof) Verify(merkleRoot []byte) bool {
+	if proof.Index < 0 || proof.Index>>uint(len(proof.Hashes)) != 0 {
+		return false
+	}
+
+	return bytes.Equal(proof.Root(), merkleRoot)
+}
+
+
+// Tx decodes the transaction the proof is for.
+func (proof *MerkleProof) Tx() (Transaction, error) {
+	return DecodeTransaction(proof.Transaction)
+}
@@ -0,0 +1,106 @@
+package blockchain
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"fmt"
+	"testing"
+)
+
+func leafHash(tx *Transaction) []byte {
+	hash := sha256.Sum256(tx.Serialize())
+
+	return hash[:]
+}
+
+
+func pairHash(left, right []byte) []byte {
+	hash := sha256.Sum256(append(append([]byte{}, left...), right...))
+
+	return hash[:]
+}
+
+
+func testTransactions(count int) []*Transaction {
+	var txs []*Transaction
+
+	for i := 0; i < count; i++ {
+		tx := &Transaction{nil, []TxInput{{[]byte{byte(i)}, i, nil, nil}}, []TxOutput{{i + 1, []byte{byte(i)}}}}
+		tx.ID = tx.Hash()
+		txs = append(txs, tx)
+	}
+
+	return txs
+}
+
+
+func TestMerkleProofs(t *testing.T) {
+	tests := []struct {
+		count						int
+		// root works the tree out by hand from the leaf hashes
+		root						func(h [][]byte) []byte
+	}{
+		{1, func(h [][]byte) []byte {
+			return pairHash(h[0], h[0])
+		}},
+		{3, func(h [][]byte) []byte {
+			return pairHash(pairHash(h[0], h[1]), pairHash(h[2], h[2]))
+		}},
+		{5, func(h [][]byte) []byte {
+			last := pairHash(h[4], h[4])
+			return pairHash(pairHash(pairHash(h[0], h[1]), pairHash(h[2], h[3])), pairHash(last, last))
+		}},
+	}
+
+	for _, test := range tests {
+		t.Run(fmt.Sprintf("%d transactions", test.count), func(t *testing.T) {
+			txs := testTransactions(test.count)
+			var leaves [][]byte
+			for _, tx := range txs {
+				leaves = append(leaves, leafHash(tx))
+			}
+
+			block := Block{Transactions: txs}
+			root := block.HashTransactions()
+			if want := test.root(leaves); !bytes.Equal(root, want) {
+				t.Fatalf("merkle root is %x, want %x", root, want)
+			}
+
+			for index, tx := range txs {
+				proof, err := block.MerkleProof(tx.ID)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if !proof.Verify(root) {
+					t.Fatalf("proof of transaction %d does not verify", index)
+				}
+				if proven, err := proof.Tx(); err != nil || !bytes.Equal(proven.ID, tx.ID) {
+					t.Fatalf("proof holds transaction %x, %v, want %x", proven.ID, err, tx.ID)
+				}
+
+				tampered := *proof
+				tampered.Hashes = append([][]byte{}, proof.Hashes...)
+				tampered.Hashes[0] = pairHash(proof.Hashes[0], nil)
+				if tampered.Verify(root) {
+					t.Fatalf("proof of transaction %d verifies with a tampered hash", index)
+				}
+
+				// the index says which side each hash goes on, a padded leaf
+				// hashes the same on both
+				if index^1 < test.count {
+					moved := *proof
+					moved.Index = index ^ 1
+					if moved.Verify(root) {
+						t.Fatalf("proof of transaction %d verifies at index %d", index, moved.Index)
+					}
+				}
+
+				beyond := *proof
+				beyond.Index = index + 1<<uint(len(proof.Hashes))
+				if beyond.Verify(root) {
+					t.Fatalf("proof of transaction %d verifies past the end of the tree", index)
+				}
+			}
+		})
+	}
+}
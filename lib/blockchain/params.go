@@ -0,0 +1,133 @@
+package blockchain
+
+import (
+	"math/big"
+)
+
+type ChainParams struct {
+	// easiest target a block may have
+	PowLimit						*big.Int
+	GenesisBits						uint32
+	// seconds
+	TargetBlockTime					int64
+	RetargetInterval				int
+	MaxRetargetFactor				int64
+	InitialSubsidy					int
+	HalvingInterval					int
+	MaxSupply						int
+	// blocks a coinbase output has to wait before it can be spent
+	CoinbaseMaturity				int
+	// a block has to be later than the median time of this many blocks
+	// before it
+	MedianTimeSpan					int
+	// seconds a block may be ahead of the local clock
+	MaxFutureDrift					int64
+	// bytes of the encoded block
+	MaxBlockSize					int
+	// signature checks, one per spent input
+	MaxBlockSigOps					int
+	// known blocks of the deployed network, in ascending height
+	Checkpoints						[]Checkpoint
+	// hash of the genesis block of the deployed network, a light chain takes
+	// no other header as its first
+	GenesisHash						[]byte
+}
+
+// Checkpoint pins the hash of the block at Height, branches with another
+// block there are rejected.
+type Checkpoint struct {
+	Height							int
+	Hash							[]byte
+}
+
+
+var DefaultParams = ChainParams{
+	PowLimit:					new(big.Int).Lsh(big.NewInt(1), 256-8),
+	GenesisBits:				BigToCompact(new(big.Int).Lsh(big.NewInt(1), 256-Difficulty)),
+	TargetBlockTime:			30,
+	RetargetInterval:			10,
+	MaxRetargetFactor:			4,
+	InitialSubsidy:				20,
+	HalvingInterval:			100000,
+	MaxSupply:					3800000,
+	CoinbaseMaturity:			10,
+	MedianTimeSpan:				11,
+	MaxFutureDrift:				10 * 60,
+	MaxBlockSize:				1 << 20,
+	MaxBlockSigOps:				4000,
+}
+
+
+// IssuedSupply is the total subsidy paid by the blocks up to and including
+// height, never more than MaxSupply.
+func (params *ChainParams) IssuedSupply(height int) int {
+	issued := 0
+
+	for era := 0; era*params.HalvingInterval <= height && era < 63; era++ {
+		subsidy := params.InitialSubsidy >> uint(era)
+		if subsidy == 0 {
+			break
+		}
+
+		blocks := params.HalvingInterval
+		if remaining := height - era*params.HalvingInterval + 1; remaining < blocks {
+			blocks = remaining
+		}
+
+		issued += blocks * subsidy
+		if issued >= params.MaxSupply {
+			return params.MaxSupply
+		}
+	}
+
+	return issued
+}
+
+
+func (params *ChainParams) BlockSubsidy(height int) int {
+	if height < 0 {
+		return 0
+	}
+
+	return params.IssuedSupply(height) - params.IssuedSupply(height-1)
+}
+
+
+// MoneyRange reports whether value is an amount that can exist: not negative
+// and not more than MaxSupply.
+func (params *ChainParams) MoneyRange(value int) bool {
+	return value >= 0 && value <= params.MaxSupply
+}
+
+
+func (params *ChainParams) NextHalvingHeight(height int) int {
+	return (height/params.HalvingInterval + 1) * params.HalvingInterval
+}
+
+
+func (params *ChainParams) CoinbaseMature(height, spendHeight int) bool {
+	return spendHeight-height >= params.CoinbaseMaturity
+}
+
+
+// CheckpointAt returns the hash pinned at height, if any.
+func (params *ChainParams) CheckpointAt(height int) ([]byte, bool) {
+	for _, checkpoint := range params.Checkpoints {
+		if checkpoint.Height == height {
+			return checkpoint.Hash, true
+		}
+	}
+
+	return nil, false
+}
+
+
+// LastCheckpoint returns the highest checkpoint, false without checkpoints.
+func (params *ChainParams) LastCheckpoint() (Checkpoint, bool) {
+	if len(params.Checkpoints) == 0 {
+		return Checkpoint{}, false
+	}
+
+	return params.Checkpoints[len(params.Checkpoints)-1], true
+}
+
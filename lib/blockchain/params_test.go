@@ -0,0 +1,42 @@
+package blockchain
+
+import (
+	"testing"
+)
+
+func TestSubsidySchedule(t *testing.T) {
+	params := DefaultParams
+	params.InitialSubsidy = 20
+	params.HalvingInterval = 10
+	params.MaxSupply = 360
+
+	tests := []struct {
+		height						int
+		subsidy						int
+		issued						int
+	}{
+		{0, 20, 20},
+		{9, 20, 200},
+		{10, 10, 210},
+		{19, 10, 300},
+		{20, 5, 305},
+		{30, 2, 352},
+		// the cap cuts the last subsidies short
+		{34, 2, 360},
+		{35, 0, 360},
+		{1000, 0, 360},
+	}
+
+	for _, test := range tests {
+		if subsidy := params.BlockSubsidy(test.height); subsidy != test.subsidy {
+			t.Fatalf("subsidy at height %d is %d, want %d", test.height, subsidy, test.subsidy)
+		}
+		if issued := params.IssuedSupply(test.height); issued != test.issued {
+			t.Fatalf("supply at height %d is %d, want %d", test.height, issued, test.issued)
+		}
+	}
+
+	if next := params.NextHalvingHeight(10); next != 20 {
+		t.Fatalf("next halving after height 10 is at %d, want 20", next)
+	}
+}
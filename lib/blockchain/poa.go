@@ -0,0 +1,137 @@
+package blockchain
+
+import (
+	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"math/big"
+	"tensor/lib/wallet"
+)
+
+var (
+	ErrNotInTurn = errors.New("not in turn to seal")
+
+	// seals must have s in the lower half of the curve order, the block hash
+	// covers the signature and s and N-s both verify
+	halfOrder = new(big.Int).Rsh(elliptic.P256().Params().N, 1)
+)
+
+// PoaEngine seals blocks by signing them with an authority key. The
+// authorities take turns: the block at height h is signed by authority
+// h mod len(Authorities), and every block adds the same weight.
+type PoaEngine struct {
+	// addresses allowed to sign, in turn order
+	Authorities					[]string
+	// Signer seals the blocks of this node, nil on nodes that only validate
+	Signer						*wallet.Wallet
+	pubKeyHashes				[][]byte
+}
+
+
+func NewPoaEngine(authorities []string, signer *wallet.Wallet) (*PoaEngine, error) {
+	if len(authorities) == 0 {
+		return nil, errors.New("proof of authority needs at least one authority")
+	}
+
+	engine := &PoaEngine{Authorities: authorities, Signer: signer}
+	for _, address := range authorities {
+		if !wallet.ValidateAddress(address) {
+			return nil, fmt.Errorf("authority %q is not a valid address", address)
+		}
+		fullHash := wallet.Base58Decode([]byte(address))
+		engine.pubKeyHashes = append(engine.pubKeyHashes, fullHash[1:len(fullHash)-4])
+	}
+
+	return engine, nil
+}
+
+
+// InTurn returns the index of the authority that signs the block at height.
+func (engine *PoaEngine) InTurn(height int) int {
+	return height % len(engine.Authorities)
+}
+
+
+func (engine *PoaEngine) Prepare(chain ChainReader, header *BlockHeader) error {
+	if engine.Signer == nil {
+		return errors.New("no authority key to sign with")
+	}
+
+	turn := engine.InTurn(header.Height)
+	if !bytes.Equal(wallet.PubKeyHash(engine.Signer.PublicKey), engine.pubKeyHashes[turn]) {
+		return fmt.Errorf("block %d is for %s: %w", header.Height, engine.Authorities[turn], ErrNotInTurn)
+	}
+
+	header.Bits = 0
+	header.Signer = engine.Signer.PublicKey
+
+	return nil
+}
+
+
+func (engine *PoaEngine) Seal(ctx context.Context, header *BlockHeader) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	if engine.Signer == nil {
+		return errors.New("no authority key to sign with")
+	}
+
+	r, s, err := ecdsa.Sign(rand.Reader, &engine.Signer.PrivateKey, header.SealHash())
+	if err != nil {
+		return err
+	}
+	if s.Cmp(halfOrder) > 0 {
+		s.Sub(elliptic.P256().Params().N, s)
+	}
+
+	// fixed width halves so the signature splits back unambiguously
+	header.Signature = append(r.FillBytes(make([]byte, 32)), s.FillBytes(make([]byte, 32))...)
+
+	return nil
+}
+
+
+func (engine *PoaEngine) VerifySeal(chain ChainReader, header *BlockHeader) error {
+	hash := header.Hash()
+	turn := engine.InTurn(header.Height)
+
+	if len(header.Signer) == 0 || !bytes.Equal(wallet.PubKeyHash(header.Signer), engine.pubKeyHashes[turn]) {
+		return reject(hash, RejectBadSeal, "block %d must be signed by %s", header.Height, engine.Authorities[turn])
+	}
+
+	if len(header.Signature) != 64 {
+		return reject(hash, RejectBadSeal, "signature has %d bytes", len(header.Signature))
+	}
+
+	x := new(big.Int).SetBytes(header.Signer[:len(header.Signer)/2])
+	y := new(big.Int).SetBytes(header.Signer[len(header.Signer)/2:])
+	pubKey := ecdsa.PublicKey{Curve: elliptic.P256(), X: x, Y: y}
+
+	r := new(big.Int).SetBytes(header.Signature[:32])
+	s := new(big.Int).SetBytes(header.Signature[32:])
+
+	if s.Cmp(halfOrder) > 0 {
+		return reject(hash, RejectBadSeal, "signature has a high s")
+	}
+	if !ecdsa.Verify(&pubKey, header.SealHash(), r, s) {
+		return reject(hash, RejectBadSeal, "signature does not match the signer")
+	}
+
+	return nil
+}
+
+
+// CalcDifficulty is always zero, there is no target to meet.
+func (engine *PoaEngine) CalcDifficulty(chain ChainReader, parent *BlockHeader) (uint32, error) {
+	return 0, nil
+}
+
+
+func (engine *PoaEngine) Weight(header *BlockHeader) *big.Int {
+	return big.NewInt(1)
+}
@@ -0,0 +1,131 @@
+package blockchain
+
+import (
+	"context"
+	"crypto/elliptic"
+	"errors"
+	"math/big"
+	"testing"
+
+	"tensor/lib/wallet"
+)
+
+// newPoaChain starts a chain sealed by two authorities, a and b, whose
+// genesis a signs and is paid for. It returns the engine of each.
+func newPoaChain(t *testing.T) (*BlockChain, *PoaEngine, *PoaEngine, *wallet.Wallet, *wallet.Wallet) {
+	t.Helper()
+
+	a := wallet.MakeWallet()
+	b := wallet.MakeWallet()
+	authorities := []string{string(a.Address()), string(b.Address())}
+
+	engineA, err := NewPoaEngine(authorities, a)
+	if err != nil {
+		t.Fatal(err)
+	}
+	engineB, err := NewPoaEngine(authorities, b)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	chain := startChain(t, testParams(), engineA, string(a.Address()))
+
+	return chain, engineA, engineB, a, b
+}
+
+
+func TestPoaTurns(t *testing.T) {
+	chain, engineA, engineB, a, _ := newPoaChain(t)
+
+	for height, want := range []int{0, 1, 0, 1, 0} {
+		if turn := engineA.InTurn(height); turn != want {
+			t.Fatalf("height %d is the turn of %d, want %d", height, turn, want)
+		}
+	}
+
+	genesis := tipBlock(t, chain)
+	header := BlockHeader{Version: BlockVersion, PrevHash: genesis.Hash, TimeStamp: genesis.TimeStamp + 30, Height: 1}
+	if err := engineA.Prepare(chain, &header); !errors.Is(err, ErrNotInTurn) {
+		t.Fatalf("preparing out of turn gave %v, want ErrNotInTurn", err)
+	}
+
+	block1 := sealBy(t, chain, engineB, genesis, []*Transaction{coinbaseTx(t, string(a.Address()), 20)}, nil)
+	if err := chain.AddBlock(block1); err != nil {
+		t.Fatal(err)
+	}
+	block2 := sealBy(t, chain, engineA, block1, []*Transaction{coinbaseTx(t, string(a.Address()), 20)}, nil)
+	if err := chain.AddBlock(block2); err != nil {
+		t.Fatal(err)
+	}
+
+	if bits, err := engineB.CalcDifficulty(chain, &block2.BlockHeader); err != nil || bits != 0 {
+		t.Fatalf("difficulty is %08x, %v, want 0", bits, err)
+	}
+	if block2.Bits != 0 {
+		t.Fatalf("sealed block has bits %08x", block2.Bits)
+	}
+}
+
+
+func TestPoaRejectsBadSeals(t *testing.T) {
+	tests := []struct {
+		name						string
+		// spoil breaks a block sealed by a at height 2, its turn
+		spoil						func(t *testing.T, block *Block, engineB *PoaEngine, b *wallet.Wallet)
+	}{
+		{"out of turn", func(t *testing.T, block *Block, engineB *PoaEngine, b *wallet.Wallet) {
+			block.Signer = b.PublicKey
+			if err := engineB.Seal(context.Background(), &block.BlockHeader); err != nil {
+				t.Fatal(err)
+			}
+		}},
+		{"other key", func(t *testing.T, block *Block, engineB *PoaEngine, b *wallet.Wallet) {
+			// a is named as the signer, b signs
+			if err := engineB.Seal(context.Background(), &block.BlockHeader); err != nil {
+				t.Fatal(err)
+			}
+		}},
+		{"tampered", func(t *testing.T, block *Block, engineB *PoaEngine, b *wallet.Wallet) {
+			block.Signature[5] ^= 0xff
+		}},
+		{"high s", func(t *testing.T, block *Block, engineB *PoaEngine, b *wallet.Wallet) {
+			// still a valid signature, but it gives the block another hash
+			s := new(big.Int).SetBytes(block.Signature[32:])
+			s.Sub(elliptic.P256().Params().N, s)
+			block.Signature = append(block.Signature[:32], s.FillBytes(make([]byte, 32))...)
+		}},
+		{"short", func(t *testing.T, block *Block, engineB *PoaEngine, b *wallet.Wallet) {
+			block.Signature = block.Signature[:63]
+		}},
+		{"unsigned", func(t *testing.T, block *Block, engineB *PoaEngine, b *wallet.Wallet) {
+			block.Signer = nil
+			block.Signature = nil
+		}},
+		{"changed after sealing", func(t *testing.T, block *Block, engineB *PoaEngine, b *wallet.Wallet) {
+			block.TimeStamp++
+		}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			chain, engineA, engineB, a, b := newPoaChain(t)
+			address := string(a.Address())
+
+			block1 := sealBy(t, chain, engineB, tipBlock(t, chain), []*Transaction{coinbaseTx(t, address, 20)}, nil)
+			if err := chain.AddBlock(block1); err != nil {
+				t.Fatal(err)
+			}
+
+			block := sealBy(t, chain, engineA, block1, []*Transaction{coinbaseTx(t, address, 20)}, nil)
+			test.spoil(t, block, engineB, b)
+			block.Hash = block.BlockHeader.Hash()
+
+			if err := chain.AddBlock(block); rejectCode(err) != RejectBadSeal {
+				t.Fatalf("got %v, want reject code %s", err, RejectBadSeal)
+			}
+			if height, _ := chain.GetBestHeight(); height != 1 {
+				t.Fatalf("height is %d after the rejected block", height)
+			}
+		})
+	}
+}
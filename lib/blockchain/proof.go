@@ -1,89 +1,180 @@
 package blockchain
 
 import (
-	"bytes"
+	"context"
 	"crypto/sha256"
 	"encoding/binary"
-	"fmt"
-	"log"
+	"errors"
 	"math"
 	"math/big"
+	"runtime"
+	"sync"
+	"sync/atomic"
+	"time"
 )
 
 // Take Data from the Block
 
 const (
+	// leading zero bits of the genesis target
 	Difficulty = 18
 )
 
+var (
+	ErrNonceExhausted = errors.New("no nonce meets the target")
+)
+
 
 type ProofOfWork struct{
-	Block 						*Block
+	Header 						*BlockHeader
 	Target						*big.Int
 }
 
 
 func ToHex(num int64) []byte {
-	buff := new(bytes.Buffer)
-	err := binary.Write(buff, binary.BigEndian, num)
-	if err != nil {
-		log.Panic(err)
-	}
-	return buff.Bytes()
+	buff := make([]byte, 8)
+	binary.BigEndian.PutUint64(buff, uint64(num))
+	return buff
 }
 
 
-func NewProof(block *Block) *ProofOfWork {
-	target := big.NewInt(1)
-	target.Lsh(target, uint(256-Difficulty))
-	pow := &ProofOfWork{block, target}
+func NewProof(header *BlockHeader) *ProofOfWork {
+	target := CompactToBig(header.Bits)
+	pow := &ProofOfWork{header, target}
 	return pow
 }
 
 func (pow *ProofOfWork) InitData(nonce int) []byte {
-	data := bytes.Join(
-		[][]byte{
-			pow.Block.PrevHash,
-			pow.Block.HashTransactions(),
-			ToHex(int64(nonce)),
-			ToHex(int64(Difficulty)),
-		},
-		[]byte{},
-	)
-	return data
+	header := *pow.Header
+	header.Nonce = nonce
+
+	return header.Bytes()
 }
 
-func (pow *ProofOfWork) Run() (int, []byte){
-	var intHash big.Int
-	var hash [32]byte
+// MinerConfig sets how a proof of work is searched for.
+type MinerConfig struct {
+	// Workers is the number of goroutines hashing, 0 uses every CPU
+	Workers						int
+	// OnHashrate is called about once a second with the hashes per second
+	// of all workers together
+	OnHashrate					func(hashrate float64)
+}
 
-	nonce := 0
 
-	for nonce < math.MaxInt64 {
-		data := pow.InitData(nonce)
-		hash = sha256.Sum256(data)
+// Run looks for a nonce putting the header hash below the target, each
+// worker tries every Workers-th nonce. It stops early with ctx.Err() when
+// ctx is cancelled.
+func (pow *ProofOfWork) Run(ctx context.Context, config MinerConfig) (int, []byte, error) {
+	var hashes uint64
 
-		fmt.Printf("\r%x", hash)
-		intHash.SetBytes(hash[:])
+	workers := config.Workers
+	if workers <= 0 {
+		workers = runtime.NumCPU()
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	type solution struct {
+		nonce					int
+		hash					[]byte
+	}
+	found := make(chan solution, workers)
+
+	var wg sync.WaitGroup
+	for worker := 0; worker < workers; worker++ {
+		wg.Add(1)
+		go func(first int) {
+			defer wg.Done()
+
+			var intHash big.Int
+			header := *pow.Header
+			tried := 0
+
+			for nonce := first; nonce >= 0 && nonce < math.MaxInt64; nonce += workers {
+				// counting and checking for cancellation in batches keeps
+				// the workers from contending on every hash
+				if tried == 1024 {
+					atomic.AddUint64(&hashes, uint64(tried))
+					tried = 0
+					if ctx.Err() != nil {
+						return
+					}
+				}
+				tried++
+
+				header.Nonce = nonce
+				hash := sha256.Sum256(header.Bytes())
+
+				intHash.SetBytes(hash[:])
+				if intHash.Cmp(pow.Target) == -1 {
+					found <- solution{nonce, hash[:]}
+					return
+				}
+			}
+		}(worker)
+	}
 
-		if intHash.Cmp(pow.Target) == -1 {
-			break
-		}else{
-			nonce++
+	done := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+	last, lastTime := uint64(0), time.Now()
+
+	for {
+		select {
+			case result := <-found:
+				return result.nonce, result.hash, nil
+			case <-done:
+				// a worker may have found a nonce just before all of them ended
+				select {
+					case result := <-found:
+						return result.nonce, result.hash, nil
+					default:
+				}
+				if err := ctx.Err(); err != nil {
+					return 0, nil, err
+				}
+				return 0, nil, ErrNonceExhausted
+			case now := <-ticker.C:
+				if config.OnHashrate != nil {
+					total := atomic.LoadUint64(&hashes)
+					config.OnHashrate(float64(total-last) / now.Sub(lastTime).Seconds())
+					last, lastTime = total, now
+				}
 		}
 	}
-	fmt.Println()
+}
+
+
+func (pow *ProofOfWork) Hash(nonce int) []byte {
+	hash := sha256.Sum256(pow.InitData(nonce))
 
-	return nonce, hash[:]
+	return hash[:]
 }
 
 
 func (pow *ProofOfWork) Validate() bool {
 	var intHash big.Int
-	data := pow.InitData(pow.Block.Nonce)
-	hash := sha256.Sum256(data)
 
-	intHash.SetBytes(hash[:])
+	if pow.Target.Sign() <= 0 {
+		return false
+	}
+
+	intHash.SetBytes(pow.Hash(pow.Header.Nonce))
 
 	return intHash.Cmp(pow.Target) == -1
-}
\ No newline at end of file
+}
+
+
+// Work is the expected number of hashes needed to find a block at this target.
+func (pow *ProofOfWork) Work() *big.Int {
+	denominator := new(big.Int).Add(pow.Target, big.NewInt(1))
+	numerator := new(big.Int).Lsh(big.NewInt(1), 256)
+
+	return numerator.Div(numerator, denominator)
+}
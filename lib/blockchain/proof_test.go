@@ -0,0 +1,91 @@
+package blockchain
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"math/big"
+	"sync"
+	"testing"
+	"time"
+)
+
+// hardHeader needs a hash of 1 or less, no worker will find one.
+func hardHeader() *BlockHeader {
+	return &BlockHeader{Version: BlockVersion, Bits: 0x01010000, Height: 1}
+}
+
+
+func TestRunFindsNonce(t *testing.T) {
+	header := &BlockHeader{Version: BlockVersion, Bits: BigToCompact(new(big.Int).Lsh(big.NewInt(1), 244)), Height: 1}
+
+	for _, workers := range []int{1, 4} {
+		nonce, hash, err := NewProof(header).Run(context.Background(), MinerConfig{Workers: workers})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		sealed := *header
+		sealed.Nonce = nonce
+		if !NewProof(&sealed).Validate() || !bytes.Equal(sealed.Hash(), hash) {
+			t.Fatalf("%d workers found nonce %d, which does not meet the target", workers, nonce)
+		}
+	}
+}
+
+
+func TestRunCancel(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(50*time.Millisecond, cancel)
+
+	done := make(chan error, 1)
+	go func() {
+		_, _, err := NewProof(hardHeader()).Run(ctx, MinerConfig{Workers: 4})
+		done <- err
+	}()
+
+	select {
+		case err := <-done:
+			if !errors.Is(err, context.Canceled) {
+				t.Fatalf("cancelled search gave %v, want context.Canceled", err)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatal("search went on after it was cancelled")
+	}
+
+	engine := NewPowEngine(testParams(), MinerConfig{Workers: 1})
+	if err := engine.Seal(ctx, hardHeader()); !errors.Is(err, context.Canceled) {
+		t.Fatalf("sealing with a cancelled context gave %v", err)
+	}
+}
+
+
+func TestRunReportsHashrate(t *testing.T) {
+	var mutex sync.Mutex
+	var rates []float64
+
+	config := MinerConfig{Workers: 2, OnHashrate: func(hashrate float64) {
+		mutex.Lock()
+		defer mutex.Unlock()
+		rates = append(rates, hashrate)
+	}}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 2500*time.Millisecond)
+	defer cancel()
+
+	if _, _, err := NewProof(hardHeader()).Run(ctx, config); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("search gave %v, want context.DeadlineExceeded", err)
+	}
+
+	mutex.Lock()
+	defer mutex.Unlock()
+
+	if len(rates) < 2 {
+		t.Fatalf("hashrate was reported %d times in 2.5 seconds", len(rates))
+	}
+	for _, rate := range rates {
+		if rate <= 0 {
+			t.Fatalf("reported hashrates %v", rates)
+		}
+	}
+}
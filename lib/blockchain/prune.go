@@ -0,0 +1,306 @@
+package blockchain
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"math"
+	"tensor/lib/storage"
+)
+
+const (
+	// a pruned chain keeps at least this many blocks below the tip, reorgs
+	// need the bodies of the blocks they disconnect
+	MinPruneDepth = 288
+)
+
+var (
+	pruneKey = []byte("prune")
+	prunedHeightKey = []byte("prunedheight")
+)
+
+
+func pruneDepth(txn storage.Txn) int {
+	value, err := txn.Get(pruneKey)
+	if err != nil || len(value) != 8 {
+		return 0
+	}
+
+	return int(binary.BigEndian.Uint64(value))
+}
+
+
+// EnablePruning turns on pruning, from then on only the bodies of the last
+// depth blocks of the active chain are kept. Headers and undo data stay.
+func (chain *BlockChain) EnablePruning(depth int) (int, error) {
+	chain.mutex.Lock()
+	defer chain.mutex.Unlock()
+
+	if chain.Light {
+		return 0, errors.New("a light chain keeps no blocks to prune")
+	}
+	if depth < MinPruneDepth {
+		return 0, fmt.Errorf("prune depth %d is below the minimum of %d", depth, MinPruneDepth)
+	}
+
+	err := chain.update(func(txn storage.Txn) error {
+		value := make([]byte, 8)
+		binary.BigEndian.PutUint64(value, uint64(depth))
+		return txn.Put(pruneKey, value)
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	chain.PruneDepth = depth
+
+	return chain.prune()
+}
+
+
+// PrunedHeight is the height of the highest block whose body was deleted, -1
+// when every block is still kept.
+func (chain *BlockChain) PrunedHeight() (int, error) {
+	height := -1
+
+	err := chain.view(func(txn storage.Txn) error {
+		value, err := txn.Get(prunedHeightKey)
+		if errors.Is(err, storage.ErrNotFound) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		height = int(binary.BigEndian.Uint64(value))
+		return nil
+	})
+
+	return height, err
+}
+
+
+// Prune deletes the bodies of the active chain blocks that are more than
+// PruneDepth blocks below the tip and returns how many were deleted.
+func (chain *BlockChain) Prune() (int, error) {
+	chain.mutex.Lock()
+	defer chain.mutex.Unlock()
+
+	return chain.prune()
+}
+
+
+func (chain *BlockChain) prune() (int, error) {
+	if chain.PruneDepth == 0 {
+		return 0, nil
+	}
+
+	bestHeight, err := chain.GetBestHeight()
+	if err != nil {
+		return 0, err
+	}
+
+	prunedHeight, err := chain.PrunedHeight()
+	if err != nil {
+		return 0, err
+	}
+
+	count := 0
+
+	for height := prunedHeight + 1; height <= bestHeight-chain.PruneDepth; height++ {
+		hash, err := chain.GetBlockHash(height)
+		if err != nil {
+			return count, err
+		}
+
+		err = chain.update(func(txn storage.Txn) error {
+			if err := txn.Delete(hash); err != nil {
+				return err
+			}
+			value := make([]byte, 8)
+			binary.BigEndian.PutUint64(value, uint64(height))
+			return txn.Put(prunedHeightKey, value)
+		})
+		if err != nil {
+			return count, fmt.Errorf("pruning block %x: %w", hash, err)
+		}
+		count++
+	}
+
+	return count, nil
+}
+
+
+// getBlockData reads the encoded block stored under hash. The header of a
+// pruned block outlives its body, that tells pruned and unknown blocks apart.
+func (chain *BlockChain) getBlockData(txn storage.Txn, hash []byte) ([]byte, error) {
+	data, err := txn.Get(hash)
+	if errors.Is(err, storage.ErrNotFound) && chain.PruneDepth > 0 {
+		if _, headerErr := txn.Get(headerKey(hash)); headerErr == nil {
+			return nil, ErrBlockPruned
+		}
+	}
+
+	return data, err
+}
+
+
+// coinsTransaction stands in for a transaction whose block was pruned, built
+// from its outputs that are still unspent. The spent outputs are left empty.
+func coinsTransaction(txID []byte, coins map[int]UTXO) (Transaction, int) {
+	tx := Transaction{ID: txID}
+	height := 0
+
+	for out, utxo := range coins {
+		for len(tx.Outputs) <= out {
+			tx.Outputs = append(tx.Outputs, TxOutput{})
+		}
+		tx.Outputs[out] = utxo.TxOutput
+		height = utxo.Height
+
+		if utxo.Coinbase {
+			tx.Inputs = []TxInput{{[]byte{}, -1, nil, nil}}
+		}
+	}
+
+	return tx, height
+}
+
+
+// unspentCoins reads the unspent outputs of txID created at or below
+// maxHeight, keyed by output index.
+func unspentCoins(txn storage.Txn, txID []byte, maxHeight int) (map[int]UTXO, error) {
+	coins := make(map[int]UTXO)
+	prefix := append(append([]byte{}, utxoprefix...), txID...)
+
+	err := txn.Iterate(prefix, func(key, value []byte) error {
+		utxo, err := DeserializeUTXO(value)
+		if err != nil {
+			return err
+		}
+		if utxo.Height <= maxHeight {
+			_, out := parseUTXOKey(key)
+			coins[out] = utxo
+		}
+		return nil
+	})
+
+	return coins, err
+}
+
+
+// unspentTransaction finds a transaction of a pruned block in the UTXO set,
+// it is only found while some of its outputs are unspent.
+func (chain *BlockChain) unspentTransaction(ID []byte) (Transaction, int, error) {
+	var coins map[int]UTXO
+
+	err := chain.view(func(txn storage.Txn) error {
+		var err error
+		coins, err = unspentCoins(txn, ID, math.MaxInt)
+		return err
+	})
+	if err != nil {
+		return Transaction{}, 0, err
+	}
+	if len(coins) == 0 {
+		return Transaction{}, 0, fmt.Errorf("transaction %x is in a pruned block and fully spent: %w", ID, ErrNotFound)
+	}
+
+	tx, height := coinsTransaction(ID, coins)
+
+	return tx, height, nil
+}
+
+
+// prunedInputs finds the inputs of block that the walk down its branch did
+// not reach before hitting a pruned block. Below walked the branch is the
+// active chain, so they are read from the UTXO set as it was where block
+// forks off: outputs the active chain spent since are put back from its undo
+// data, outputs it created since are left out.
+func (chain *BlockChain) prunedInputs(block *Block, walked []*Block, needed map[string]bool, prevTxs map[string]Transaction, prevHeights map[string]int) error {
+	bestHeight, err := chain.GetBestHeight()
+	if err != nil {
+		return err
+	}
+
+	coins := make(map[string]map[int]UTXO)
+
+	err = chain.view(func(txn storage.Txn) error {
+		forkHeight := block.Height - 1
+		if len(walked) > 0 {
+			forkHeight = walked[len(walked)-1].Height - 1
+		}
+		for _, branchBlock := range walked {
+			if hash, err := txn.Get(heightKey(branchBlock.Height)); err == nil && bytes.Equal(hash, branchBlock.Hash) {
+				forkHeight = branchBlock.Height
+				break
+			}
+		}
+
+		for txID := range needed {
+			ID, err := hex.DecodeString(txID)
+			if err != nil {
+				return err
+			}
+			if coins[txID], err = unspentCoins(txn, ID, forkHeight); err != nil {
+				return err
+			}
+		}
+
+		for height := forkHeight + 1; height <= bestHeight; height++ {
+			hash, err := txn.Get(heightKey(height))
+			if err != nil {
+				return err
+			}
+			value, err := txn.Get(undoKey(hash))
+			if err != nil {
+				return fmt.Errorf("undo data for block %x: %w", hash, err)
+			}
+			undo, err := DeserializeUndo(value)
+			if err != nil {
+				return err
+			}
+
+			for _, spentOutputs := range undo.Spent {
+				for _, spent := range spentOutputs {
+					txID := hex.EncodeToString(spent.TxID)
+					if needed[txID] && spent.Height <= forkHeight {
+						coins[txID][spent.Out] = UTXO{spent.Output, spent.Height, spent.Coinbase}
+					}
+				}
+			}
+		}
+
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	for _, tx := range block.Transactions {
+		if tx.IsCoinbase() {
+			continue
+		}
+		for _, input := range tx.Inputs {
+			txCoins, ok := coins[hex.EncodeToString(input.ID)]
+			if !ok || len(txCoins) == 0 {
+				continue
+			}
+			if _, unspent := txCoins[input.Out]; !unspent {
+				return reject(block.Hash, RejectInvalidTransaction, "output %x:%d is already spent", input.ID, input.Out)
+			}
+		}
+	}
+
+	for txID, txCoins := range coins {
+		if len(txCoins) == 0 {
+			continue
+		}
+		ID, _ := hex.DecodeString(txID)
+		prevTxs[txID], prevHeights[txID] = coinsTransaction(ID, txCoins)
+		delete(needed, txID)
+	}
+
+	return nil
+}
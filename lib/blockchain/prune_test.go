@@ -0,0 +1,148 @@
+package blockchain
+
+import (
+	"bytes"
+	"encoding/hex"
+	"errors"
+	"reflect"
+	"testing"
+
+	"tensor/lib/wallet"
+)
+
+func TestPruneInventory(t *testing.T) {
+	chain, miner := newTestChain(t, testParams())
+	address := string(miner.Address())
+
+	tip := MinPruneDepth + 5
+	parent := tipBlock(t, chain)
+	for height := 1; height <= tip; height++ {
+		parent = mineOn(t, chain, parent, address)
+	}
+
+	if _, err := chain.EnablePruning(10); err == nil {
+		t.Fatal("pruning to a depth below MinPruneDepth was enabled")
+	}
+	if hashes, err := chain.GetBlockHashes(0); err != nil || len(hashes) != tip+1 {
+		t.Fatalf("inventory has %d hashes, %v, want %d", len(hashes), err, tip+1)
+	}
+
+	count, err := chain.EnablePruning(MinPruneDepth)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if count != 6 {
+		t.Fatalf("pruned %d blocks, want 6", count)
+	}
+
+	prunedHeight, err := chain.PrunedHeight()
+	if err != nil || prunedHeight != 5 {
+		t.Fatalf("pruned height is %d, %v, want 5", prunedHeight, err)
+	}
+	if _, err := chain.GetBlockByHeight(prunedHeight); !errors.Is(err, ErrBlockPruned) {
+		t.Fatalf("reading a pruned block gave %v, want ErrBlockPruned", err)
+	}
+	if _, err := chain.GetBlockByHeight(prunedHeight + 1); err != nil {
+		t.Fatal(err)
+	}
+
+	// peers are only offered the blocks still kept
+	hashes, err := chain.GetBlockHashes(prunedHeight + 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(hashes) != MinPruneDepth {
+		t.Fatalf("inventory has %d hashes, want %d", len(hashes), MinPruneDepth)
+	}
+	for _, hash := range hashes {
+		if _, err := chain.GetBlock(hash); err != nil {
+			t.Fatalf("block %x is offered but not kept: %v", hash, err)
+		}
+	}
+
+	// a new block moves the pruned height along
+	mineOn(t, chain, parent, address)
+	if prunedHeight, err := chain.PrunedHeight(); err != nil || prunedHeight != 6 {
+		t.Fatalf("pruned height is %d, %v after the next block, want 6", prunedHeight, err)
+	}
+
+	// the indexes can not be rebuilt without the pruned blocks, and are
+	// left as they were
+	before := storedUTXOs(t, chain)
+	if err := (UTXOSet{chain}).Reindex(); !errors.Is(err, ErrBlockPruned) {
+		t.Fatalf("reindexing the UTXO set gave %v, want ErrBlockPruned", err)
+	}
+	if _, err := chain.ReindexTransactions(); !errors.Is(err, ErrBlockPruned) || chain.TxIndex {
+		t.Fatalf("reindexing transactions gave %v, index on %v", err, chain.TxIndex)
+	}
+	if _, err := chain.ReindexAddresses(); !errors.Is(err, ErrBlockPruned) || chain.AddrIndex {
+		t.Fatalf("reindexing addresses gave %v, index on %v", err, chain.AddrIndex)
+	}
+	if after := storedUTXOs(t, chain); !reflect.DeepEqual(after, before) {
+		t.Fatalf("UTXO set went from %d to %d outputs", len(before), len(after))
+	}
+}
+
+
+func TestPrunedSideBranch(t *testing.T) {
+	chain, miner := newTestChain(t, testParams())
+	address := string(miner.Address())
+	payee := string(wallet.MakeWallet().Address())
+	genesis := tipBlock(t, chain)
+
+	// pay's block is pruned by the time the side branch spends from it
+	pay := payTo(t, chain, miner, genesis.Transactions[0], 0, output(t, address, 15), output(t, address, 5))
+	parent := mineOn(t, chain, genesis, address, pay)
+	spendLow := payTo(t, chain, miner, pay, 1, output(t, address, 5))
+	spendMain := payTo(t, chain, miner, pay, 0, output(t, address, 15))
+	spendSide := payTo(t, chain, miner, pay, 0, output(t, payee, 15))
+	spendLowAgain := payTo(t, chain, miner, pay, 1, output(t, payee, 5))
+
+	tip := MinPruneDepth + 5
+	var fork *Block
+	for height := 2; height <= tip; height++ {
+		switch height {
+			case 10:
+				parent = mineOn(t, chain, parent, address, spendLow)
+			case tip - 3:
+				fork = parent
+				parent = mineOn(t, chain, parent, address, spendMain)
+			default:
+				parent = mineOn(t, chain, parent, address)
+		}
+	}
+	if _, err := chain.EnablePruning(MinPruneDepth); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := chain.GetBlockByHeight(1); !errors.Is(err, ErrBlockPruned) {
+		t.Fatalf("block of pay gave %v, want ErrBlockPruned", err)
+	}
+
+	// output 1 was spent below the fork, on both branches
+	lowAgain := sealBlock(t, chain, fork, []*Transaction{coinbaseTx(t, address, 20), spendLowAgain}, nil)
+	if err := chain.AddBlock(lowAgain); rejectCode(err) != RejectInvalidTransaction {
+		t.Fatalf("spending an output spent below the fork gave %v", err)
+	}
+
+	// output 0 was spent above the fork, only on the active chain
+	side := mineOn(t, chain, fork, address, spendSide)
+	if !bytes.Equal(chain.Tip(), parent.Hash) {
+		t.Fatal("the shorter side branch took over")
+	}
+	for side.Height <= tip {
+		side = mineOn(t, chain, side, address)
+	}
+	if !bytes.Equal(chain.Tip(), side.Hash) {
+		t.Fatalf("tip is %x, want the side branch %x", chain.Tip(), side.Hash)
+	}
+
+	utxos := storedUTXOs(t, chain)
+	for _, spent := range []Outpoint{{hex.EncodeToString(pay.ID), 0}, {hex.EncodeToString(pay.ID), 1}, {hex.EncodeToString(spendMain.ID), 0}} {
+		if _, ok := utxos[spent]; ok {
+			t.Fatalf("output %s:%d is unspent after the reorg", spent.TxID, spent.Out)
+		}
+	}
+	if _, ok := utxos[Outpoint{hex.EncodeToString(spendSide.ID), 0}]; !ok {
+		t.Fatal("the side branch payment is not in the UTXO set")
+	}
+}
@@ -0,0 +1,181 @@
+package blockchain
+
+import (
+	"bytes"
+	"errors"
+	"sync"
+	"testing"
+
+	"tensor/lib/storage"
+	"tensor/lib/wallet"
+)
+
+func balanceOf(t *testing.T, chain *BlockChain, w *wallet.Wallet) int {
+	t.Helper()
+
+	balance, _, err := (&UTXOSet{chain}).Balance(wallet.PubKeyHash(w.PublicKey))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return balance
+}
+
+
+func TestReorganizeRestoresUTXOs(t *testing.T) {
+	chain, miner := newTestChain(t, testParams())
+	if _, err := chain.ReindexTransactions(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := chain.ReindexAddresses(); err != nil {
+		t.Fatal(err)
+	}
+	payee := wallet.MakeWallet()
+	address := string(miner.Address())
+
+	genesis := tipBlock(t, chain)
+	fork := mineOn(t, chain, genesis, address)
+	pay := payTo(t, chain, miner, genesis.Transactions[0], 0, output(t, string(payee.Address()), 15), output(t, address, 5))
+	main1 := mineOn(t, chain, fork, address, pay)
+	checkUTXOs(t, chain)
+
+	if balance := balanceOf(t, chain, payee); balance != 15 {
+		t.Fatalf("payee has %d before the reorg, want 15", balance)
+	}
+
+	// a longer branch without the payment takes over
+	side1 := mineOn(t, chain, fork, address)
+	side2 := mineOn(t, chain, side1, address)
+
+	if !bytes.Equal(chain.Tip(), side2.Hash) {
+		t.Fatalf("tip is %x, want the side branch %x", chain.Tip(), side2.Hash)
+	}
+	checkUTXOs(t, chain)
+	if balance := balanceOf(t, chain, payee); balance != 0 {
+		t.Fatalf("payee has %d on the side branch, want 0", balance)
+	}
+	if _, err := chain.FindTransaction(pay.ID); !errors.Is(err, ErrNotFound) {
+		t.Fatalf("payment is still indexed on the side branch: %v", err)
+	}
+	history, err := chain.AddressHistory(wallet.PubKeyHash(payee.PublicKey), 0, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(history) != 0 {
+		t.Fatalf("payee has %d history entries on the side branch, want 0", len(history))
+	}
+
+	// and the first branch takes over again
+	main2 := mineOn(t, chain, main1, address)
+	main3 := mineOn(t, chain, main2, address)
+
+	if !bytes.Equal(chain.Tip(), main3.Hash) {
+		t.Fatalf("tip is %x, want the main branch %x", chain.Tip(), main3.Hash)
+	}
+	checkUTXOs(t, chain)
+	if balance := balanceOf(t, chain, payee); balance != 15 {
+		t.Fatalf("payee has %d back on the main branch, want 15", balance)
+	}
+	if history, err = chain.AddressHistory(wallet.PubKeyHash(payee.PublicKey), 0, 10); err != nil || len(history) != 1 {
+		t.Fatalf("payee history back on the main branch: %d entries, %v", len(history), err)
+	}
+}
+
+
+func TestFailedReorganizeKeepsTip(t *testing.T) {
+	chain, miner := newTestChain(t, testParams())
+	address := string(miner.Address())
+
+	genesis := tipBlock(t, chain)
+	main1 := mineOn(t, chain, genesis, address)
+	main2 := mineOn(t, chain, main1, address)
+
+	// without its undo data the tip can not be disconnected
+	err := chain.Database.Update(func(txn storage.Txn) error {
+		return txn.Delete(undoKey(main2.Hash))
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	before := storedUTXOs(t, chain)
+
+	side1 := mineOn(t, chain, genesis, address)
+	side2 := mineOn(t, chain, side1, address)
+	side3 := sealBlock(t, chain, side2, []*Transaction{coinbaseTx(t, address, chain.Params.BlockSubsidy(3))}, nil)
+
+	if err := chain.AddBlock(side3); !errors.Is(err, ErrNotFound) {
+		t.Fatalf("reorganizing without undo data gave %v, want ErrNotFound", err)
+	}
+
+	if !bytes.Equal(chain.Tip(), main2.Hash) {
+		t.Fatalf("tip moved to %x", chain.Tip())
+	}
+	var stored []byte
+	chain.Database.View(func(txn storage.Txn) error {
+		stored, err = txn.Get([]byte("lh"))
+		return err
+	})
+	if !bytes.Equal(stored, main2.Hash) {
+		t.Fatalf("stored tip moved to %x", stored)
+	}
+	if height, err := chain.GetBestHeight(); err != nil || height != 2 {
+		t.Fatalf("best height is %d, %v, want 2", height, err)
+	}
+	if after := storedUTXOs(t, chain); len(after) != len(before) {
+		t.Fatalf("UTXO set went from %d to %d outputs", len(before), len(after))
+	}
+	checkUTXOs(t, chain)
+}
+
+
+func TestConcurrentAddBlock(t *testing.T) {
+	params := testParams()
+	chain, miner := newTestChain(t, params)
+	address := string(miner.Address())
+	genesis := tipBlock(t, chain)
+
+	// each branch is built on a chain of its own, then all are fed to chain
+	// at once
+	var branches [4][]*Block
+	for i := range branches {
+		builder, err := CreateBlockChainFromGenesis(storage.NewMemory(), chain.Engine, genesis)
+		if err != nil {
+			t.Fatal(err)
+		}
+		useTestSettings(t, builder, params)
+
+		parent := genesis
+		for height := 1; height <= 3+i; height++ {
+			parent = mineOn(t, builder, parent, address)
+			branches[i] = append(branches[i], parent)
+		}
+	}
+
+	var wg sync.WaitGroup
+	errs := make(chan error, len(branches))
+
+	for _, branch := range branches {
+		wg.Add(1)
+		go func(blocks []*Block) {
+			defer wg.Done()
+			for _, block := range blocks {
+				if err := chain.AddBlock(block); err != nil {
+					errs <- err
+					return
+				}
+			}
+		}(branch)
+	}
+	wg.Wait()
+	close(errs)
+
+	for err := range errs {
+		t.Fatal(err)
+	}
+
+	longest := branches[len(branches)-1]
+	if tip := longest[len(longest)-1]; !bytes.Equal(chain.Tip(), tip.Hash) {
+		t.Fatalf("tip is %x, want %x", chain.Tip(), tip.Hash)
+	}
+	checkUTXOs(t, chain)
+}
@@ -6,10 +6,8 @@ import (
 	"crypto/elliptic"
 	"crypto/rand"
 	"crypto/sha256"
-	"encoding/gob"
 	"encoding/hex"
 	"fmt"
-	"log"
 	"math/big"
 	"strings"
 	"tensor/lib/wallet"
@@ -23,13 +21,7 @@ type Transaction struct {
 
 
 func (tx Transaction) Serialize() []byte {
-	var encoded bytes.Buffer
-
-	encode := gob.NewEncoder(&encoded)
-	err := encode.Encode(tx)
-	HandleError(err)
-	
-	return encoded.Bytes()
+	return EncodeTransaction(&tx)
 }
 
 func (tx *Transaction) Hash() []byte {
@@ -45,36 +37,35 @@ func (tx *Transaction) Hash() []byte {
 
 
 
-func DeserializeTransaction(data []byte) Transaction {
-	var transactin Transaction
-
-	err := gob.NewDecoder(bytes.NewReader(data)).Decode(&transactin)
-	HandleError(err)
-
-	return transactin
+func DeserializeTransaction(data []byte) (Transaction, error) {
+	return DecodeTransaction(data)
 }
 
 
 
 
-func CoinbaseTx(to, data string) *Transaction {
+func CoinbaseTx(to, data string, value int) (*Transaction, error) {
 	if data == "" {
 		randomData := make([]byte, 24)
-		_, err := rand.Read(randomData)
-		HandleError(err)
+		if _, err := rand.Read(randomData); err != nil {
+			return nil, err
+		}
 		data = fmt.Sprintf("%x", randomData)
 	}
 
 	fmt.Println(data)
 
 	Txin := TxInput{[]byte{}, -1, nil, []byte(data)}
-	Txout := NewTxOutput(20, to)
+	Txout, err := NewTxOutput(value, to)
+	if err != nil {
+		return nil, err
+	}
 
 	tx := Transaction{nil, []TxInput{Txin}, []TxOutput{*Txout}}
 
 	tx.ID = tx.Hash()
 
-	return &tx
+	return &tx, nil
 }
 
 
@@ -83,6 +74,34 @@ func (tx *Transaction) IsCoinbase() bool {
 }
 
 
+func (tx *Transaction) OutputValue() int {
+	total := 0
+
+	for _, output := range tx.Outputs {
+		total += output.Value
+	}
+
+	return total
+}
+
+
+// Fee is what the inputs of a transaction are worth beyond its outputs, the
+// miner including it collects the difference.
+func (tx *Transaction) Fee(prevTxs map[string]Transaction) int {
+	if tx.IsCoinbase() {
+		return 0
+	}
+
+	inputs := 0
+
+	for _, input := range tx.Inputs {
+		inputs += prevTxs[hex.EncodeToString(input.ID)].Outputs[input.Out].Value
+	}
+
+	return inputs - tx.OutputValue()
+}
+
+
 func (tx *Transaction) TrimmedCopy() Transaction {
 	var inputs []TxInput
 	var outputs []TxOutput
@@ -101,14 +120,15 @@ func (tx *Transaction) TrimmedCopy() Transaction {
 }
 
 
-func (tx *Transaction) Sign(privKey ecdsa.PrivateKey, prevTxs map[string]Transaction) {
+func (tx *Transaction) Sign(privKey ecdsa.PrivateKey, prevTxs map[string]Transaction) error {
 	if tx.IsCoinbase() {
-		return
+		return nil
 	}
 
 	for _, in := range tx.Inputs {
-		if prevTxs[hex.EncodeToString(in.ID)].ID == nil{
-			log.Panic("Error: Previous Transaction does not exist")
+		prevTx, ok := prevTxs[hex.EncodeToString(in.ID)]
+		if !ok || in.Out < 0 || in.Out >= len(prevTx.Outputs) {
+			return fmt.Errorf("previous output %x:%d: %w", in.ID, in.Out, ErrNotFound)
 		}
 	}
 
@@ -122,31 +142,40 @@ func (tx *Transaction) Sign(privKey ecdsa.PrivateKey, prevTxs map[string]Transac
 		txCopy.Inputs[inputId].PubKey = nil
 
 		r, s, err := ecdsa.Sign(rand.Reader, &privKey, txCopy.ID)
-		HandleError(err)
-		Signature := append(r.Bytes(), s.Bytes()...)
+		if err != nil {
+			return err
+		}
+		Signature := append(r.FillBytes(make([]byte, 32)), s.FillBytes(make([]byte, 32))...)
 
 		tx.Inputs[inputId].Signature = Signature
 	}
+
+	return nil
 }
 
 
 
-func NewTransaction(w *wallet.Wallet, to, nodeID string, amount int, UTXO *UTXOSet) *Transaction {
+func NewTransaction(w *wallet.Wallet, to, nodeID string, amount, fee int, UTXO *UTXOSet) (*Transaction, error) {
 	var inputs []TxInput
 	var outputs []TxOutput
 
 	
 	pubKeyHash := wallet.PubKeyHash(w.PublicKey)
 
-	accumulator, validOutputs := UTXO.FindSpendableOutputs(pubKeyHash, amount)
+	accumulator, validOutputs, err := UTXO.FindSpendableOutputs(pubKeyHash, amount+fee)
+	if err != nil {
+		return nil, err
+	}
 
-	if accumulator < amount {
-		log.Panic("Error: not enough funds")
+	if accumulator < amount+fee {
+		return nil, fmt.Errorf("have %d, need %d: %w", accumulator, amount+fee, ErrInsufficientFunds)
 	}
 
 	for txid, out := range validOutputs {
 		txID, err := hex.DecodeString(txid)
-		HandleError(err)
+		if err != nil {
+			return nil, err
+		}
 
 		for _, out := range out{
 			input := TxInput{txID, out, nil, w.PublicKey}
@@ -154,19 +183,29 @@ func NewTransaction(w *wallet.Wallet, to, nodeID string, amount int, UTXO *UTXOS
 		}
 	}
 
-	outputs = append(outputs, *NewTxOutput(amount, to))
+	output, err := NewTxOutput(amount, to)
+	if err != nil {
+		return nil, err
+	}
+	outputs = append(outputs, *output)
 
-	if accumulator > amount {
-		outputs = append(outputs, *NewTxOutput(accumulator-amount, string(w.Address())))
+	if accumulator > amount+fee {
+		change, err := NewTxOutput(accumulator-amount-fee, string(w.Address()))
+		if err != nil {
+			return nil, err
+		}
+		outputs = append(outputs, *change)
 	}
 
 	tx := Transaction{nil, inputs, outputs}
 	tx.ID = tx.Hash()
 
-	UTXO.BlockChain.SignTransaction(&tx, w.PrivateKey)
+	if err := UTXO.BlockChain.SignTransaction(&tx, w.PrivateKey); err != nil {
+		return nil, err
+	}
 
 
-	return &tx
+	return &tx, nil
 }
 
 func (tx *Transaction) Verify(prevTxs map[string]Transaction) bool {
@@ -175,8 +214,13 @@ func (tx *Transaction) Verify(prevTxs map[string]Transaction) bool {
 	}
 
 	for _, in := range tx.Inputs {
-		if prevTxs[hex.EncodeToString(in.ID)].ID == nil{
-			log.Panic("Error: Previous Transaction does not exist")
+		prevTx, ok := prevTxs[hex.EncodeToString(in.ID)]
+		if !ok || in.Out < 0 || in.Out >= len(prevTx.Outputs) {
+			return false
+		}
+		// only the key the output is locked to may spend it
+		if !bytes.Equal(wallet.PubKeyHash(in.PubKey), prevTx.Outputs[in.Out].PubKeyHash) {
+			return false
 		}
 	}
 
@@ -190,12 +234,13 @@ func (tx *Transaction) Verify(prevTxs map[string]Transaction) bool {
 		txCopy.ID = txCopy.Hash()
 		txCopy.Inputs[index].PubKey = nil
 
-		
+		if len(input.Signature) != 64 {
+			return false
+		}
 		r := big.Int{}
 		s := big.Int{}
-		sigLen := len(input.Signature)
-		r.SetBytes(input.Signature[:(sigLen / 2)])
-		s.SetBytes(input.Signature[(sigLen / 2):])
+		r.SetBytes(input.Signature[:32])
+		s.SetBytes(input.Signature[32:])
 
 		x := big.Int{}
 		y := big.Int{}
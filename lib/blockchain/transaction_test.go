@@ -0,0 +1,308 @@
+package blockchain
+
+import (
+	"bytes"
+	"context"
+	"encoding/hex"
+	"errors"
+	"math"
+	"testing"
+
+	"tensor/lib/storage"
+	"tensor/lib/wallet"
+)
+
+func TestVerifyChecksOwner(t *testing.T) {
+	chain, _ := newTestChain(t, testParams())
+	thief := wallet.MakeWallet()
+	genesis := tipBlock(t, chain)
+	coinbase := genesis.Transactions[0]
+
+	// the thief signs with its own key, the output is locked to the miner
+	tx := &Transaction{nil, []TxInput{{coinbase.ID, 0, nil, thief.PublicKey}}, []TxOutput{output(t, string(thief.Address()), 20)}}
+	tx.ID = tx.Hash()
+	prevTxs := map[string]Transaction{hex.EncodeToString(coinbase.ID): *coinbase}
+	if err := tx.Sign(thief.PrivateKey, prevTxs); err != nil {
+		t.Fatal(err)
+	}
+
+	if tx.Verify(prevTxs) {
+		t.Fatal("a key the output is not locked to spends it")
+	}
+	if err := chain.VerifyTransaction(tx); !errors.Is(err, ErrInvalidTransaction) {
+		t.Fatalf("VerifyTransaction gave %v, want ErrInvalidTransaction", err)
+	}
+
+	block := sealBlock(t, chain, genesis, []*Transaction{coinbaseTx(t, string(thief.Address()), 20), tx}, nil)
+	if err := chain.AddBlock(block); rejectCode(err) != RejectInvalidTransaction {
+		t.Fatalf("block with the theft gave %v", err)
+	}
+}
+
+
+func TestVerifyTransactionDoubleSpend(t *testing.T) {
+	chain, miner := newTestChain(t, testParams())
+	address := string(miner.Address())
+	genesis := tipBlock(t, chain)
+	coinbase := genesis.Transactions[0]
+
+	first := payTo(t, chain, miner, coinbase, 0, output(t, address, 20))
+	mineOn(t, chain, genesis, address, first)
+
+	again := payTo(t, chain, miner, coinbase, 0, output(t, address, 19))
+	if err := chain.VerifyTransaction(again); !errors.Is(err, ErrInvalidTransaction) {
+		t.Fatalf("spending a spent output gave %v", err)
+	}
+
+	tip := tipBlock(t, chain)
+	twice := &Transaction{nil, []TxInput{{tip.Transactions[0].ID, 0, nil, miner.PublicKey}, {tip.Transactions[0].ID, 0, nil, miner.PublicKey}}, []TxOutput{output(t, address, 40)}}
+	twice.ID = twice.Hash()
+	if err := chain.SignTransaction(twice, miner.PrivateKey); err != nil {
+		t.Fatal(err)
+	}
+	if err := chain.VerifyTransaction(twice); !errors.Is(err, ErrInvalidTransaction) {
+		t.Fatalf("spending one output twice gave %v", err)
+	}
+}
+
+
+func TestMineBlockRejectsConflicts(t *testing.T) {
+	chain, miner := newTestChain(t, testParams())
+	address := string(miner.Address())
+	coinbase := tipBlock(t, chain).Transactions[0]
+
+	first := payTo(t, chain, miner, coinbase, 0, output(t, address, 20))
+	second := payTo(t, chain, miner, coinbase, 0, output(t, address, 19))
+	reward := coinbaseTx(t, address, 20)
+
+	if _, err := chain.MineBlock(context.Background(), []*Transaction{reward, first, second}); rejectCode(err) != RejectInvalidTransaction {
+		t.Fatalf("mining a double spend gave %v", err)
+	}
+	if height, _ := chain.GetBestHeight(); height != 0 {
+		t.Fatalf("height is %d after the rejected block", height)
+	}
+}
+
+
+func TestCheckValues(t *testing.T) {
+	chain, _ := newTestChain(t, testParams())
+	maxSupply := chain.Params.MaxSupply
+	prevID := bytes.Repeat([]byte{0x01}, 32)
+
+	tests := []struct {
+		name						string
+		inputs						[]int
+		outputs						[]int
+		fee							int
+		ok							bool
+	}{
+		{"fee", []int{10, 5}, []int{12}, 3, true},
+		{"whole supply", []int{maxSupply}, []int{maxSupply}, 0, true},
+		{"spends more", []int{10}, []int{11}, 0, false},
+		{"zero output", []int{10}, []int{0, 10}, 0, false},
+		{"negative output", []int{10}, []int{-5, 15}, 0, false},
+		{"output over supply", []int{10}, []int{maxSupply + 1}, 0, false},
+		// the sum wraps negative and would cover any input
+		{"output sum wraps", []int{10}, []int{math.MaxInt64, 2}, 0, false},
+		{"outputs over supply", []int{maxSupply, maxSupply}, []int{maxSupply, 1}, 0, false},
+		{"inputs over supply", []int{maxSupply, 1}, []int{1}, 0, false},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			prevTx := Transaction{ID: prevID}
+			tx := &Transaction{}
+			for out, value := range test.inputs {
+				prevTx.Outputs = append(prevTx.Outputs, TxOutput{value, nil})
+				tx.Inputs = append(tx.Inputs, TxInput{prevID, out, nil, nil})
+			}
+			for _, value := range test.outputs {
+				tx.Outputs = append(tx.Outputs, TxOutput{value, nil})
+			}
+
+			fee, err := chain.checkValues(tx, map[string]Transaction{hex.EncodeToString(prevID): prevTx})
+			if test.ok && (err != nil || fee != test.fee) {
+				t.Fatalf("got fee %d, %v, want %d", fee, err, test.fee)
+			}
+			if !test.ok && err == nil {
+				t.Fatal("out of range values were accepted")
+			}
+		})
+	}
+}
+
+
+func TestCoinbaseOverSupply(t *testing.T) {
+	chain, miner := newTestChain(t, testParams())
+	address := string(miner.Address())
+	genesis := tipBlock(t, chain)
+
+	coinbase := coinbaseTx(t, address, 20)
+	coinbase.Outputs = append(coinbase.Outputs, TxOutput{math.MaxInt64, coinbase.Outputs[0].PubKeyHash})
+	coinbase.ID = coinbase.Hash()
+
+	block := sealBlock(t, chain, genesis, []*Transaction{coinbase}, nil)
+	if err := chain.AddBlock(block); !errors.Is(err, ErrInvalidBlock) {
+		t.Fatalf("coinbase over the supply gave %v", err)
+	}
+}
+
+
+func TestCoinbaseMaturity(t *testing.T) {
+	params := testParams()
+	params.CoinbaseMaturity = 3
+	chain, miner := newTestChain(t, params)
+	address := string(miner.Address())
+	genesis := tipBlock(t, chain)
+
+	spend := payTo(t, chain, miner, genesis.Transactions[0], 0, output(t, address, 20))
+	if err := chain.VerifyTransaction(spend); !errors.Is(err, ErrInvalidTransaction) {
+		t.Fatalf("spending an immature coinbase gave %v", err)
+	}
+	early := sealBlock(t, chain, genesis, []*Transaction{coinbaseTx(t, address, 20), spend}, nil)
+	if err := chain.AddBlock(early); rejectCode(err) != RejectInvalidTransaction {
+		t.Fatalf("block spending an immature coinbase gave %v", err)
+	}
+
+	parent := mineOn(t, chain, genesis, address)
+	parent = mineOn(t, chain, parent, address)
+	if spendable, immature, err := (&UTXOSet{chain}).Balance(wallet.PubKeyHash(miner.PublicKey)); err != nil || spendable != 20 || immature != 40 {
+		t.Fatalf("balance is %d spendable, %d immature, %v", spendable, immature, err)
+	}
+
+	// at height 3 the genesis coinbase has waited 3 blocks
+	if err := chain.VerifyTransaction(spend); err != nil {
+		t.Fatal(err)
+	}
+	mineOn(t, chain, parent, address, spend)
+}
+
+
+func TestMineCoinbaseOnly(t *testing.T) {
+	chain, miner := newTestChain(t, testParams())
+
+	for height := 1; height <= 3; height++ {
+		coinbase := coinbaseTx(t, string(miner.Address()), chain.Params.BlockSubsidy(height))
+		block, err := chain.MineBlock(context.Background(), []*Transaction{coinbase})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if block.Height != height {
+			t.Fatalf("mined height %d, want %d", block.Height, height)
+		}
+	}
+
+	if balance := balanceOf(t, chain, miner); balance != 4*chain.Params.BlockSubsidy(0) {
+		t.Fatalf("miner has %d after mining 3 blocks", balance)
+	}
+}
+
+
+func TestDuplicateTransaction(t *testing.T) {
+	chain, miner := newTestChain(t, testParams())
+	address := string(miner.Address())
+
+	// the same coinbase data gives the same transaction id
+	repeated := func() *Transaction {
+		tx, err := CoinbaseTx(address, "repeated", chain.Params.BlockSubsidy(1))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return tx
+	}
+
+	genesis := tipBlock(t, chain)
+	first := sealBlock(t, chain, genesis, []*Transaction{repeated()}, nil)
+	if err := chain.AddBlock(first); err != nil {
+		t.Fatal(err)
+	}
+
+	second := sealBlock(t, chain, first, []*Transaction{repeated()}, nil)
+	if err := chain.AddBlock(second); rejectCode(err) != RejectInvalidTransaction {
+		t.Fatalf("adding a repeated coinbase gave %v, want RejectInvalidTransaction", err)
+	}
+	if _, err := chain.GetBlock(second.Hash); !errors.Is(err, ErrNotFound) {
+		t.Fatalf("rejected block was stored, %v", err)
+	}
+
+	// a side branch is only checked once it is connected, its first
+	// repeat is fine as the branch does not hold the first block
+	main2 := mineOn(t, chain, first, address)
+	side1 := mineOn(t, chain, genesis, address)
+	side2 := sealBlock(t, chain, side1, []*Transaction{repeated()}, nil)
+	if err := chain.AddBlock(side2); err != nil {
+		t.Fatal(err)
+	}
+	before := storedUTXOs(t, chain)
+
+	side3 := sealBlock(t, chain, side2, []*Transaction{repeated()}, nil)
+	if err := chain.AddBlock(side3); rejectCode(err) != RejectInvalidTransaction {
+		t.Fatalf("reorganizing onto a repeated coinbase gave %v, want RejectInvalidTransaction", err)
+	}
+	if !bytes.Equal(chain.Tip(), main2.Hash) {
+		t.Fatalf("tip moved to %x", chain.Tip())
+	}
+	if after := storedUTXOs(t, chain); len(after) != len(before) {
+		t.Fatalf("UTXO set went from %d to %d outputs", len(before), len(after))
+	}
+	checkUTXOs(t, chain)
+}
+
+
+func TestInvalidAddress(t *testing.T) {
+	engine := NewPowEngine(testParams(), MinerConfig{Workers: 1})
+
+	for _, address := range []string{"", "0OIl", "1111111111111111111111111111111111"} {
+		if _, err := CoinbaseTx(address, "", 20); !errors.Is(err, ErrInvalidAddress) {
+			t.Fatalf("coinbase to %q gave %v", address, err)
+		}
+		if _, err := CreateBlockChain(storage.NewMemory(), engine, address); !errors.Is(err, ErrInvalidAddress) {
+			t.Fatalf("chain paying %q gave %v", address, err)
+		}
+	}
+}
+
+
+func TestSignatureWidth(t *testing.T) {
+	chain, miner := newTestChain(t, testParams())
+	coinbase := tipBlock(t, chain).Transactions[0]
+	prevTxs := map[string]Transaction{hex.EncodeToString(coinbase.ID): *coinbase}
+
+	// r or s is shorter than 32 bytes about once in 128 signatures
+	for i := 0; i < 300; i++ {
+		tx := payTo(t, chain, miner, coinbase, 0, output(t, string(miner.Address()), i+1))
+		if length := len(tx.Inputs[0].Signature); length != 64 {
+			t.Fatalf("signature has %d bytes", length)
+		}
+		if !tx.Verify(prevTxs) {
+			t.Fatal("signature does not verify")
+		}
+	}
+
+	tx := payTo(t, chain, miner, coinbase, 0, output(t, string(miner.Address()), 20))
+	for _, signature := range [][]byte{tx.Inputs[0].Signature[:63], append(tx.Inputs[0].Signature, 0)} {
+		bad := *tx
+		bad.Inputs = []TxInput{tx.Inputs[0]}
+		bad.Inputs[0].Signature = signature
+		if bad.Verify(prevTxs) {
+			t.Fatalf("signature of %d bytes verifies", len(signature))
+		}
+	}
+}
+
+
+func TestSignaturesCheckedBelowCheckpoint(t *testing.T) {
+	params := testParams()
+	params.Checkpoints = []Checkpoint{{10, bytes.Repeat([]byte{0x01}, 32)}}
+	chain, miner := newTestChain(t, params)
+	address := string(miner.Address())
+	genesis := tipBlock(t, chain)
+
+	tx := payTo(t, chain, miner, genesis.Transactions[0], 0, output(t, address, 20))
+	tx.Inputs[0].Signature[10] ^= 0xff
+
+	block := sealBlock(t, chain, genesis, []*Transaction{coinbaseTx(t, address, 20), tx}, nil)
+	if err := chain.AddBlock(block); rejectCode(err) != RejectInvalidTransaction {
+		t.Fatalf("bad signature below a checkpoint gave %v", err)
+	}
+}
@@ -20,17 +20,41 @@ type TxInput struct {
 }
 
 
-type TxOutputs struct {
-	Outputs				[]TxOutput
+// UTXO is an unspent output together with what is needed to spend it.
+type UTXO struct {
+	TxOutput
+	Height				int
+	Coinbase			bool
+}
+
+type Outpoint struct {
+	TxID				string
+	Out					int
+}
+
+// SpentOutput is an output a block spent, kept so the block can be reverted.
+type SpentOutput struct {
+	TxID				[]byte
+	Out					int
+	Output				TxOutput
+	Height				int
+	Coinbase			bool
+}
+
+// BlockUndo holds the outputs spent by each transaction of a block.
+type BlockUndo struct {
+	Spent				[][]SpentOutput
 }
 
 
 
-func NewTxOutput(value int, address string) *TxOutput {
+func NewTxOutput(value int, address string) (*TxOutput, error) {
 	txo := &TxOutput{value, nil}
-	txo.Lock([]byte(address))
+	if err := txo.Lock([]byte(address)); err != nil {
+		return nil, err
+	}
 	fmt.Printf("key: %x\n", txo.PubKeyHash)
-	return txo
+	return txo, nil
 }
 
 
@@ -40,9 +64,13 @@ func (in *TxInput) UsesKey(pubKeyHash []byte) bool {
 	return bytes.Equal(lockingHash, pubKeyHash)
 }
 
-func (out *TxOutput) Lock(address []byte) {
+func (out *TxOutput) Lock(address []byte) error {
+	if !wallet.ValidateAddress(string(address)) {
+		return fmt.Errorf("%q: %w", address, ErrInvalidAddress)
+	}
 	pubKeyHash := wallet.Base58Decode(address)
 	out.PubKeyHash = pubKeyHash[1: len(pubKeyHash)-4]
+	return nil
 }
 
 
@@ -51,19 +79,25 @@ func (out *TxOutput) IsLockedWithKey(pubKeyHash []byte) bool {
 }
 
 
-func (outs TxOutputs) Serialize() []byte {
-	var buffer bytes.Buffer
-	encode := gob.NewEncoder(&buffer)
-	err := encode.Encode(outs)
-	HandleError(err)
-	return buffer.Bytes()
+func (utxo UTXO) Serialize() []byte {
+	return encodeLegacy(utxo)
 }
 
-func DeserializeOutputs(data []byte) TxOutputs {
-	var outputs TxOutputs
+func DeserializeUTXO(data []byte) (UTXO, error) {
+	var utxo UTXO
 	decode := gob.NewDecoder(bytes.NewReader(data))
-	err := decode.Decode(&outputs)
-	HandleError(err)
-	return outputs
+	err := decode.Decode(&utxo)
+	return utxo, err
 }
 
+
+func (undo BlockUndo) Serialize() []byte {
+	return encodeLegacy(undo)
+}
+
+func DeserializeUndo(data []byte) (BlockUndo, error) {
+	var undo BlockUndo
+	decode := gob.NewDecoder(bytes.NewReader(data))
+	err := decode.Decode(&undo)
+	return undo, err
+}
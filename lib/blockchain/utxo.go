@@ -2,16 +2,19 @@ package blockchain
 
 import (
 	"bytes"
+	"encoding/binary"
 	"encoding/hex"
+	"errors"
 	"fmt"
-	"log"
-
-	"github.com/dgraph-io/badger"
+	"tensor/lib/storage"
 )
 
 var (
-	utxoprefix = []byte("utxo-")
-	prefixlength = len(utxoprefix)
+	// every unspent output is stored on its own under its (txid, vout)
+	utxoprefix = []byte("coin-")
+	undoprefix = []byte("undo-")
+	// the old layout kept all unspent outputs of a transaction in one entry
+	legacyutxoprefix = []byte("utxo-")
 )
 
 type UTXOSet struct {
@@ -19,47 +22,58 @@ type UTXOSet struct {
 }
 
 
-func (u *UTXOSet) DeleteByPrefix(prefix []byte) {
-	deleteKeys := func(KeysForDelete [][]byte) error {
-		if err := u.BlockChain.Database.Update(func(txn *badger.Txn) error {
-			for _, key := range KeysForDelete {
-				if err := txn.Delete(key); err != nil {
-					return err
-				}
-			}
-			return nil
-		}); err != nil {
-			return err
-		}
-		return nil
-	}
+func utxoKey(txID []byte, out int) []byte {
+	key := append(append([]byte{}, utxoprefix...), txID...)
+	key = append(key, 0, 0, 0, 0)
+	binary.BigEndian.PutUint32(key[len(key)-4:], uint32(out))
 
-	collectionSize := 100000
+	return key
+}
 
-	u.BlockChain.Database.View(func(txn *badger.Txn) error {
-		opts := badger.DefaultIteratorOptions
-		opts.PrefetchValues = false
-		it := txn.NewIterator(opts)
-		defer it.Close()
 
-		keysForDelete := make([][]byte, 0, collectionSize)
-		keysCollected := 0
+// parseUTXOKey returns the hex txid and output index a UTXO is stored under.
+func parseUTXOKey(key []byte) (string, int) {
+	outpoint := bytes.TrimPrefix(key, utxoprefix)
+	txID := outpoint[:len(outpoint)-4]
+	out := binary.BigEndian.Uint32(outpoint[len(outpoint)-4:])
 
-		for it.Seek(prefix); it.ValidForPrefix(prefix); it.Next() {
-			key := it.Item().KeyCopy(nil)
-			keysForDelete = append(keysForDelete, key)
-			keysCollected++
-			if keysCollected == collectionSize {
-				if err := deleteKeys(keysForDelete); err != nil {
-					log.Panic(err)
-				}
-				keysForDelete = make([][]byte, 0, collectionSize)
-				keysCollected = 0
+	return hex.EncodeToString(txID), int(out)
+}
+
+
+func undoKey(blockHash []byte) []byte {
+	return append(append([]byte{}, undoprefix...), blockHash...)
+}
+
+
+func (u *UTXOSet) DeleteByPrefix(prefix []byte) error {
+	return u.BlockChain.DeleteByPrefix(prefix)
+}
+
+
+func (u UTXOSet) Reindex() error {
+	if u.BlockChain.PruneDepth > 0 {
+		return fmt.Errorf("reindexing the UTXO set needs every block: %w", ErrBlockPruned)
+	}
+
+	if err := u.DeleteByPrefix(utxoprefix); err != nil {
+		return err
+	}
+
+	UTXO, err := u.BlockChain.FindUTXO()
+	if err != nil {
+		return err
+	}
+
+	return u.BlockChain.update(func(txn storage.Txn) error {
+		for outpoint, utxo := range UTXO {
+			txID, err := hex.DecodeString(outpoint.TxID)
+			if err != nil {
+				return err
 			}
-		}
-		if keysCollected > 0 {
-			if err := deleteKeys(keysForDelete); err != nil {
-				log.Panic(err)
+
+			if err := txn.Put(utxoKey(txID, outpoint.Out), utxo.Serialize()); err != nil {
+				return err
 			}
 		}
 		return nil
@@ -67,170 +81,271 @@ func (u *UTXOSet) DeleteByPrefix(prefix []byte) {
 }
 
 
-func (u UTXOSet) Reindex() {
-	db := u.BlockChain.Database
+// MigrateLegacy rebuilds the UTXO set from the chain when it is still stored
+// in the old per transaction layout, whose output indexes cannot be trusted.
+func (u UTXOSet) MigrateLegacy() (bool, error) {
+	legacy := false
 
-	u.DeleteByPrefix(utxoprefix)
+	err := u.BlockChain.view(func(txn storage.Txn) error {
+		return txn.Iterate(legacyutxoprefix, func(key, value []byte) error {
+			legacy = true
+			return storage.ErrStop
+		})
+	})
+	if err != nil || !legacy {
+		return false, err
+	}
 
-	UTXO := u.BlockChain.FindUTXO()
+	fmt.Println("Migrating the UTXO set to outpoint keys")
+	if err := u.DeleteByPrefix(legacyutxoprefix); err != nil {
+		return false, err
+	}
 
-	err := db.Update(func(txn *badger.Txn) error {
-		for txId, outs := range UTXO {
-			key, err := hex.DecodeString(txId)
-			HandleError(err)
+	return true, u.Reindex()
+}
 
-			key = append(utxoprefix, key...)
 
-			err = txn.Set(key, outs.Serialize())
-			HandleError(err)
-		}
-		return nil
+func (u UTXOSet) Update(block *Block) error {
+	return u.BlockChain.update(func(txn storage.Txn) error {
+		_, err := updateCoins(txn, block)
+		return err
+	})
+}
+
+
+// Revert undoes Update for a block that is the tip of the chain.
+func (u UTXOSet) Revert(block *Block) error {
+	return u.BlockChain.update(func(txn storage.Txn) error {
+		return revertCoins(txn, block)
 	})
-	HandleError(err)
-}
-
-func (u UTXOSet) Update(block *Block) {
-	db := u.BlockChain.Database
-
-	err := db.Update(func(txn *badger.Txn) error {
-		for _, tx := range block.Transactions {
-			if !tx.IsCoinbase() {
-				for _, input := range tx.Inputs {
-					updatedOuts := TxOutputs{}
-					inputID := append(utxoprefix, input.ID...)
-					item, err := txn.Get(inputID)
-					HandleError(err)
-					value, err := item.ValueCopy(nil)
-					HandleError(err)
-					
-					outs := DeserializeOutputs(value)
-
-					for Outindex, out := range outs.Outputs {
-						if Outindex != input.Out {
-							updatedOuts.Outputs = append(updatedOuts.Outputs, out)
-						}
-					}
-
-					if len(updatedOuts.Outputs) == 0 {
-						err := txn.Delete(inputID)
-						HandleError(err)
-					}else{
-						err := txn.Set(inputID, updatedOuts.Serialize())
-						HandleError(err)
-					}
+}
 
 
+// updateCoins spends the inputs of block and adds its outputs in txn. The
+// spent outputs are stored as the undo record of the block and returned.
+func updateCoins(txn storage.Txn, block *Block) (BlockUndo, error) {
+	undo := BlockUndo{make([][]SpentOutput, len(block.Transactions))}
+
+	for txIndex, tx := range block.Transactions {
+		if !tx.IsCoinbase() {
+			for _, input := range tx.Inputs {
+				key := utxoKey(input.ID, input.Out)
+				value, err := txn.Get(key)
+				if err != nil {
+					return undo, fmt.Errorf("output %x:%d: %w", input.ID, input.Out, dbError(err))
 				}
-			}
 
-			newOutputs := TxOutputs{}
-			for _, out := range tx.Outputs {
-				newOutputs.Outputs = append(newOutputs.Outputs, out)
+				utxo, err := DeserializeUTXO(value)
+				if err != nil {
+					return undo, err
+				}
+				spent := SpentOutput{input.ID, input.Out, utxo.TxOutput, utxo.Height, utxo.Coinbase}
+				undo.Spent[txIndex] = append(undo.Spent[txIndex], spent)
+
+				if err := txn.Delete(key); err != nil {
+					return undo, err
+				}
 			}
+		}
 
-			txID := append(utxoprefix, tx.ID...)
-			err := txn.Set(txID, newOutputs.Serialize())
-			HandleError(err)
+		for index, out := range tx.Outputs {
+			key := utxoKey(tx.ID, index)
+			// outputs are keyed by txid, a repeated txid would overwrite
+			// outputs that are still unspent
+			if _, err := txn.Get(key); err == nil {
+				return undo, reject(block.Hash, RejectInvalidTransaction, "transaction %x overwrites unspent output %d", tx.ID, index)
+			}else if !errors.Is(err, storage.ErrNotFound) {
+				return undo, err
+			}
 
+			utxo := UTXO{out, block.Height, tx.IsCoinbase()}
+			if err := txn.Put(key, utxo.Serialize()); err != nil {
+				return undo, err
+			}
 		}
-		return nil
+	}
+
+	return undo, txn.Put(undoKey(block.Hash), undo.Serialize())
+}
+
+
+// hasCoins reports whether txID has outputs in the UTXO set.
+func (chain *BlockChain) hasCoins(txID []byte) (bool, error) {
+	found := false
+
+	err := chain.view(func(txn storage.Txn) error {
+		prefix := append(append([]byte{}, utxoprefix...), txID...)
+		return txn.Iterate(prefix, func(key, value []byte) error {
+			found = true
+			return storage.ErrStop
+		})
 	})
-	HandleError(err)
+
+	return found, err
 }
 
 
+// getUndo reads the undo record updateCoins stored for block.
+func getUndo(txn storage.Txn, block *Block) (BlockUndo, error) {
+	value, err := txn.Get(undoKey(block.Hash))
+	if err != nil {
+		return BlockUndo{}, fmt.Errorf("undo data for block %x: %w", block.Hash, dbError(err))
+	}
 
-func (u UTXOSet) CountTransactions() int {
-	db := u.BlockChain.Database
-	counter := 0
+	return DeserializeUndo(value)
+}
+
+
+// revertCoins undoes updateCoins in txn: the outputs block created are
+// removed and the outputs it spent are put back from its undo record.
+func revertCoins(txn storage.Txn, block *Block) error {
+	undo, err := getUndo(txn, block)
+	if err != nil {
+		return err
+	}
 
-	err := db.View(func(txn *badger.Txn) error {
-		opts := badger.DefaultIteratorOptions
+	for txIndex := len(block.Transactions) - 1; txIndex >= 0; txIndex-- {
+		tx := block.Transactions[txIndex]
 
-		it := txn.NewIterator(opts)
-		defer it.Close()
+		for index := range tx.Outputs {
+			if err := txn.Delete(utxoKey(tx.ID, index)); err != nil {
+				return err
+			}
+		}
+
+		spentOutputs := undo.Spent[txIndex]
+
+		for i := len(spentOutputs) - 1; i >= 0; i-- {
+			spent := spentOutputs[i]
+			utxo := UTXO{spent.Output, spent.Height, spent.Coinbase}
 
-		for it.Seek(utxoprefix); it.ValidForPrefix(utxoprefix); it.Next() {
-			counter++
+			if err := txn.Put(utxoKey(spent.TxID, spent.Out), utxo.Serialize()); err != nil {
+				return err
+			}
 		}
-		return nil
+	}
+
+	return txn.Delete(undoKey(block.Hash))
+}
+
+
+
+// CountTransactions returns how many transactions have unspent outputs.
+func (u UTXOSet) CountTransactions() (int, error) {
+	counter := 0
+
+	err := u.BlockChain.view(func(txn storage.Txn) error {
+		lastTxID := ""
+
+		return txn.Iterate(utxoprefix, func(key, value []byte) error {
+			txID, _ := parseUTXOKey(key)
+			if txID != lastTxID {
+				counter++
+				lastTxID = txID
+			}
+			return nil
+		})
 	})
-	HandleError(err)
-	return counter
+
+	return counter, err
 }
 
 
 
-func (u *UTXOSet) FindUnspentTransactions(pubKeyHash []byte) []TxOutput {
+func (u *UTXOSet) FindUnspentTransactions(pubKeyHash []byte) ([]TxOutput, error) {
 	var UTXOs []TxOutput
-	
-	db := u.BlockChain.Database
 
-	err := db.View(func(txn *badger.Txn) error {
-		opts := badger.DefaultIteratorOptions
+	err := u.BlockChain.view(func(txn storage.Txn) error {
+		return txn.Iterate(utxoprefix, func(key, value []byte) error {
+			utxo, err := DeserializeUTXO(value)
+			if err != nil {
+				return err
+			}
+
+			if utxo.IsLockedWithKey(pubKeyHash) {
+				UTXOs = append(UTXOs, utxo.TxOutput)
+			}
+			return nil
+		})
+	})
 
-		it := txn.NewIterator(opts)
-		defer it.Close()
+	return UTXOs, err
+}
 
-		for it.Seek(utxoprefix); it.ValidForPrefix(utxoprefix); it.Next() {
-			item := it.Item()
-			value, err := item.ValueCopy(nil)
-			HandleError(err)
-			outs := DeserializeOutputs(value)
 
-			for _, out := range outs.Outputs {
-				if out.IsLockedWithKey(pubKeyHash) {
-					UTXOs = append(UTXOs, out)
-				}
+
+// Balance returns the value locked to pubKeyHash that can be spent in the next
+// block, and the value of coinbase outputs that are not mature yet.
+func (u *UTXOSet) Balance(pubKeyHash []byte) (int, int, error) {
+	spendable, immature := 0, 0
+
+	bestHeight, err := u.BlockChain.GetBestHeight()
+	if err != nil {
+		return 0, 0, err
+	}
+	spendHeight := bestHeight + 1
+
+	err = u.BlockChain.view(func(txn storage.Txn) error {
+		return txn.Iterate(utxoprefix, func(key, value []byte) error {
+			utxo, err := DeserializeUTXO(value)
+			if err != nil {
+				return err
 			}
-		}
-		return nil
+
+			if !utxo.IsLockedWithKey(pubKeyHash) {
+				return nil
+			}
+
+			if !utxo.Coinbase || u.BlockChain.Params.CoinbaseMature(utxo.Height, spendHeight) {
+				spendable += utxo.Value
+			}else {
+				immature += utxo.Value
+			}
+			return nil
+		})
 	})
-	HandleError(err)
-	
-	fmt.Println("DONE")
-	
-	return UTXOs
+
+	return spendable, immature, err
 }
 
 
 
-func (u UTXOSet) FindSpendableOutputs(pubKeyHash []byte, amont int) (int, map[string][]int) {
+func (u UTXOSet) FindSpendableOutputs(pubKeyHash []byte, amont int) (int, map[string][]int, error) {
 	unspentOutputs := make(map[string][]int)
 	accumulated := 0
-	db := u.BlockChain.Database
-
 
-	err := db.View(func(txn *badger.Txn) error {
-		opts := badger.DefaultIteratorOptions
+	bestHeight, err := u.BlockChain.GetBestHeight()
+	if err != nil {
+		return 0, nil, err
+	}
+	spendHeight := bestHeight + 1
 
-		it := txn.NewIterator(opts)
-		defer it.Close()
 
-		for it.Seek(utxoprefix); it.ValidForPrefix(utxoprefix); it.Next() {
-			item := it.Item()
-			k := item.Key()
-			value, err := item.ValueCopy(nil)
-			HandleError(err)
-			k = bytes.TrimPrefix(k, utxoprefix)
-			txID := hex.EncodeToString(k)
-			outs := DeserializeOutputs(value)
+	err = u.BlockChain.view(func(txn storage.Txn) error {
+		return txn.Iterate(utxoprefix, func(key, value []byte) error {
+			if accumulated >= amont {
+				return storage.ErrStop
+			}
 
-			for outIndex, out :=  range outs.Outputs {
-				if out.IsLockedWithKey(pubKeyHash) && accumulated < amont{
-				accumulated += out.Value
-				unspentOutputs[txID] = append(unspentOutputs[txID], outIndex)
+			utxo, err := DeserializeUTXO(value)
+			if err != nil {
+				return err
+			}
 
-				if accumulated >= amont {
-					break 
-				}
+			if !utxo.IsLockedWithKey(pubKeyHash) {
+				return nil
 			}
+
+			if utxo.Coinbase && !u.BlockChain.Params.CoinbaseMature(utxo.Height, spendHeight) {
+				return nil
 			}
-		}
 
-		return nil
+			txID, outIndex := parseUTXOKey(key)
+			accumulated += utxo.Value
+			unspentOutputs[txID] = append(unspentOutputs[txID], outIndex)
+			return nil
+		})
 	})
-	HandleError(err)
 
-	return accumulated, unspentOutputs
-}
\ No newline at end of file
+	return accumulated, unspentOutputs, err
+}
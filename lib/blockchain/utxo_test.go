@@ -0,0 +1,127 @@
+package blockchain
+
+import (
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"reflect"
+	"testing"
+
+	"tensor/lib/storage"
+)
+
+func TestRevert(t *testing.T) {
+	chain, miner := newTestChain(t, testParams())
+	address := string(miner.Address())
+	genesis := tipBlock(t, chain)
+	utxos := UTXOSet{chain}
+
+	pay := payTo(t, chain, miner, genesis.Transactions[0], 0, output(t, address, 15), output(t, address, 5))
+	block := sealBlock(t, chain, genesis, []*Transaction{coinbaseTx(t, address, 20), pay}, nil)
+	before := storedUTXOs(t, chain)
+
+	if err := utxos.Update(block); err != nil {
+		t.Fatal(err)
+	}
+	after := storedUTXOs(t, chain)
+	if _, ok := after[Outpoint{hex.EncodeToString(genesis.Transactions[0].ID), 0}]; ok {
+		t.Fatal("spent output is still in the set")
+	}
+	if utxo, ok := after[Outpoint{hex.EncodeToString(pay.ID), 1}]; !ok || utxo.Value != 5 || utxo.Height != 1 {
+		t.Fatalf("new output is %+v, %t", utxo, ok)
+	}
+
+	if err := utxos.Revert(block); err != nil {
+		t.Fatal(err)
+	}
+	if reverted := storedUTXOs(t, chain); !reflect.DeepEqual(reverted, before) {
+		t.Fatalf("reverting left %d outputs, want the %d from before", len(reverted), len(before))
+	}
+
+	// the undo record goes with the revert
+	if err := utxos.Revert(block); !errors.Is(err, ErrNotFound) {
+		t.Fatalf("reverting twice gave %v, want ErrNotFound", err)
+	}
+}
+
+
+func TestGenesisCoins(t *testing.T) {
+	// newTestChain does not reindex, a new chain is usable as created
+	chain, _ := newTestChain(t, testParams())
+	genesis := tipBlock(t, chain)
+
+	utxos := storedUTXOs(t, chain)
+	if utxo, ok := utxos[Outpoint{hex.EncodeToString(genesis.Transactions[0].ID), 0}]; len(utxos) != 1 || !ok || utxo.Height != 0 || !utxo.Coinbase {
+		t.Fatalf("new chain holds %d outputs, genesis coinbase %+v, %t", len(utxos), utxo, ok)
+	}
+	checkUTXOs(t, chain)
+
+	err := chain.Database.View(func(txn storage.Txn) error {
+		_, err := getUndo(txn, genesis)
+		return err
+	})
+	if err != nil {
+		t.Fatalf("reading the undo data of the genesis gave %v", err)
+	}
+}
+
+
+func TestMigrateLegacy(t *testing.T) {
+	chain, miner := newTestChain(t, testParams())
+	address := string(miner.Address())
+	genesis := tipBlock(t, chain)
+
+	// output 0 is spent and output 1 is not, the old layout lost track of
+	// which index the unspent one had
+	pay := payTo(t, chain, miner, genesis.Transactions[0], 0, output(t, address, 15), output(t, address, 5))
+	block1 := mineOn(t, chain, genesis, address, pay)
+	mineOn(t, chain, block1, address, payTo(t, chain, miner, pay, 0, output(t, address, 15)))
+	want := storedUTXOs(t, chain)
+
+	if migrated, err := (UTXOSet{chain}).MigrateLegacy(); err != nil || migrated {
+		t.Fatalf("migrating the current layout gave %t, %v", migrated, err)
+	}
+
+	err := chain.Database.Update(func(txn storage.Txn) error {
+		for outpoint := range want {
+			txID, _ := hex.DecodeString(outpoint.TxID)
+			if err := txn.Delete(utxoKey(txID, outpoint.Out)); err != nil {
+				return err
+			}
+			legacy := struct{ Outputs []TxOutput }{[]TxOutput{want[outpoint].TxOutput}}
+			if err := txn.Put(append(append([]byte{}, legacyutxoprefix...), txID...), encodeLegacy(legacy)); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// opening the chain migrates it
+	loaded, err := LoadBlockChain(chain.Database, chain.Engine)
+	if err != nil {
+		t.Fatal(err)
+	}
+	loaded.Params = chain.Params
+
+	if got := storedUTXOs(t, loaded); !reflect.DeepEqual(got, want) {
+		t.Fatalf("migrated set has %d outputs, want %d", len(got), len(want))
+	}
+	if _, ok := storedUTXOs(t, loaded)[Outpoint{hex.EncodeToString(pay.ID), 1}]; !ok {
+		t.Fatal("the unspent output lost its index")
+	}
+
+	err = loaded.Database.View(func(txn storage.Txn) error {
+		return txn.Iterate(legacyutxoprefix, func(key, value []byte) error {
+			return fmt.Errorf("legacy entry %x is left", key)
+		})
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if migrated, err := (UTXOSet{loaded}).MigrateLegacy(); err != nil || migrated {
+		t.Fatalf("migrating twice gave %t, %v", migrated, err)
+	}
+}
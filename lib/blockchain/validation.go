@@ -0,0 +1,437 @@
+package blockchain
+
+import (
+	"bytes"
+	"encoding/hex"
+	"errors"
+	"fmt"
+)
+
+type RejectCode int
+
+const (
+	RejectInvalidHash RejectCode = iota + 1
+	RejectProofOfWork
+	RejectUnknownParent
+	RejectBadHeight
+	RejectBadDifficulty
+	RejectBadMerkleRoot
+	RejectBadCoinbase
+	RejectInvalidTransaction
+	RejectBadSeal
+	RejectCheckpoint
+	RejectBlockTooLarge
+	RejectBadTimestamp
+)
+
+type BlockError struct {
+	Code							RejectCode
+	Hash							[]byte
+	Reason							string
+}
+
+
+func (code RejectCode) String() string {
+	switch code {
+		case RejectInvalidHash:
+			return "invalid hash"
+		case RejectProofOfWork:
+			return "insufficient proof of work"
+		case RejectUnknownParent:
+			return "unknown parent"
+		case RejectBadHeight:
+			return "bad height"
+		case RejectBadDifficulty:
+			return "bad difficulty"
+		case RejectBadMerkleRoot:
+			return "bad merkle root"
+		case RejectBadCoinbase:
+			return "bad coinbase"
+		case RejectInvalidTransaction:
+			return "invalid transaction"
+		case RejectBadSeal:
+			return "bad seal"
+		case RejectCheckpoint:
+			return "checkpoint mismatch"
+		case RejectBlockTooLarge:
+			return "block too large"
+		case RejectBadTimestamp:
+			return "bad timestamp"
+		default:
+			return fmt.Sprintf("unknown reject code %d", int(code))
+	}
+}
+
+
+func (err *BlockError) Error() string {
+	return fmt.Sprintf("block %x rejected (%s): %s", err.Hash, err.Code, err.Reason)
+}
+
+
+// Is makes every BlockError match ErrInvalidBlock.
+func (err *BlockError) Is(target error) bool {
+	return target == ErrInvalidBlock
+}
+
+
+func reject(hash []byte, code RejectCode, format string, args ...interface{}) *BlockError {
+	return &BlockError{code, hash, fmt.Sprintf(format, args...)}
+}
+
+
+// ValidateHeader checks a header on its own: its proof of work and its place
+// on top of a known parent.
+func (chain *BlockChain) ValidateHeader(header *BlockHeader) error {
+	hash := header.Hash()
+
+	if err := chain.Engine.VerifySeal(chain, header); err != nil {
+		return err
+	}
+
+	if len(header.PrevHash) == 0 {
+		return reject(hash, RejectUnknownParent, "block has no previous block")
+	}
+
+	parent, err := chain.GetBlockHeader(header.PrevHash)
+	if errors.Is(err, ErrNotFound) {
+		return reject(hash, RejectUnknownParent, "previous block %x is not known", header.PrevHash)
+	}
+	if err != nil {
+		return err
+	}
+
+	if header.Height != parent.Height+1 {
+		return reject(hash, RejectBadHeight, "height %d does not follow parent height %d", header.Height, parent.Height)
+	}
+
+	if err := chain.checkCheckpoints(header); err != nil {
+		return err
+	}
+
+	if err := chain.checkTimestamp(header, &parent); err != nil {
+		return err
+	}
+
+	bits, err := chain.CalcNextBits(&parent)
+	if err != nil {
+		return err
+	}
+	if header.Bits != bits {
+		return reject(hash, RejectBadDifficulty, "bits %08x do not match expected %08x", header.Bits, bits)
+	}
+
+	return nil
+}
+
+
+// checkCheckpoints rejects a header with another hash than the checkpoint at
+// its height, or below a checkpoint the active chain already passed: the
+// active block at that height leads to the checkpoint, so any other one does
+// not.
+func (chain *BlockChain) checkCheckpoints(header *BlockHeader) error {
+	hash := header.Hash()
+
+	if pinned, ok := chain.Params.CheckpointAt(header.Height); ok && !bytes.Equal(pinned, hash) {
+		return reject(hash, RejectCheckpoint, "checkpoint at height %d is %x", header.Height, pinned)
+	}
+
+	for i := len(chain.Params.Checkpoints) - 1; i >= 0; i-- {
+		checkpoint := chain.Params.Checkpoints[i]
+		if header.Height > checkpoint.Height {
+			break
+		}
+
+		active, err := chain.GetBlockHash(checkpoint.Height)
+		if err != nil && !errors.Is(err, ErrNotFound) {
+			return err
+		}
+		if bytes.Equal(active, checkpoint.Hash) {
+			return reject(hash, RejectCheckpoint, "branch forks below the checkpoint at height %d", checkpoint.Height)
+		}
+	}
+
+	return nil
+}
+
+
+// ValidateBlock checks everything a block must satisfy to be stored: a valid
+// header, its merkle root, its coinbase and the transactions it spends on the
+// branch it extends.
+func (chain *BlockChain) ValidateBlock(block *Block) error {
+	if !bytes.Equal(block.BlockHeader.Hash(), block.Hash) {
+		return reject(block.Hash, RejectInvalidHash, "hash does not match block header")
+	}
+
+	if err := chain.checkBlockLimits(block); err != nil {
+		return err
+	}
+
+	if err := chain.ValidateHeader(&block.BlockHeader); err != nil {
+		return err
+	}
+
+	if len(block.Transactions) == 0 {
+		return reject(block.Hash, RejectBadCoinbase, "block has no transactions")
+	}
+
+	if !bytes.Equal(block.HashTransactions(), block.MerkleRoot) {
+		return reject(block.Hash, RejectBadMerkleRoot, "merkle root does not match transactions")
+	}
+
+	coinbases := 0
+	for _, tx := range block.Transactions {
+		if tx.IsCoinbase() {
+			coinbases++
+		}
+	}
+	if coinbases != 1 {
+		return reject(block.Hash, RejectBadCoinbase, "block has %d coinbase transactions", coinbases)
+	}
+
+	return chain.validateTransactions(block)
+}
+
+
+// validateGenesis checks a genesis block that was not sealed by this node.
+func (chain *BlockChain) validateGenesis(block *Block) error {
+	if !bytes.Equal(block.BlockHeader.Hash(), block.Hash) {
+		return reject(block.Hash, RejectInvalidHash, "hash does not match block header")
+	}
+
+	if err := chain.validateGenesisHeader(&block.BlockHeader); err != nil {
+		return err
+	}
+
+	if !bytes.Equal(block.HashTransactions(), block.MerkleRoot) {
+		return reject(block.Hash, RejectBadMerkleRoot, "merkle root does not match transactions")
+	}
+
+	if len(block.Transactions) != 1 || !block.Transactions[0].IsCoinbase() {
+		return reject(block.Hash, RejectBadCoinbase, "genesis block has to hold a coinbase only")
+	}
+
+	if claimed, allowed := block.Transactions[0].OutputValue(), chain.Params.BlockSubsidy(0); claimed > allowed {
+		return reject(block.Hash, RejectBadCoinbase, "coinbase pays %d, only %d is allowed", claimed, allowed)
+	}
+
+	return nil
+}
+
+
+func (chain *BlockChain) validateTransactions(block *Block) error {
+	prevTxs, prevHeights, err := chain.findBranchInputs(block)
+	if err != nil {
+		return err
+	}
+
+	var coinbase *Transaction
+	fees := 0
+	seen := make(map[string]bool)
+	// side branches are checked when they are connected, updateCoins
+	// refuses to overwrite outputs there
+	extendsTip := bytes.Equal(block.PrevHash, chain.Tip())
+	// the last checkpoint vouches for the signatures of its ancestors
+	assumed, err := chain.assumedValid(block.Hash)
+	if err != nil {
+		return err
+	}
+
+	for _, tx := range block.Transactions {
+		txID := hex.EncodeToString(tx.ID)
+
+		if !bytes.Equal(tx.ID, unsignedHash(tx)) {
+			return reject(block.Hash, RejectInvalidTransaction, "transaction %x has a wrong id", tx.ID)
+		}
+
+		if seen[txID] {
+			return reject(block.Hash, RejectInvalidTransaction, "transaction %x is included twice", tx.ID)
+		}
+
+		if extendsTip {
+			unspent, err := chain.hasCoins(tx.ID)
+			if err != nil {
+				return err
+			}
+			if unspent {
+				return reject(block.Hash, RejectInvalidTransaction, "transaction %x repeats a transaction with unspent outputs", tx.ID)
+			}
+		}
+
+		if !tx.IsCoinbase() {
+			for _, input := range tx.Inputs {
+				prevTx, ok := prevTxs[hex.EncodeToString(input.ID)]
+				if !ok {
+					return reject(block.Hash, RejectInvalidTransaction, "transaction %x spends unknown transaction %x", tx.ID, input.ID)
+				}
+
+				if input.Out < 0 || input.Out >= len(prevTx.Outputs) {
+					return reject(block.Hash, RejectInvalidTransaction, "transaction %x spends missing output %x:%d", tx.ID, input.ID, input.Out)
+				}
+
+				if prevTx.IsCoinbase() && !chain.Params.CoinbaseMature(prevHeights[hex.EncodeToString(input.ID)], block.Height) {
+					return reject(block.Hash, RejectInvalidTransaction, "transaction %x spends immature coinbase %x", tx.ID, input.ID)
+				}
+			}
+
+			if !assumed && !tx.Verify(prevTxs) {
+				return reject(block.Hash, RejectInvalidTransaction, "transaction %x has an invalid signature", tx.ID)
+			}
+
+			fee, err := chain.checkValues(tx, prevTxs)
+			if err != nil {
+				return reject(block.Hash, RejectInvalidTransaction, "transaction %x: %s", tx.ID, err)
+			}
+			fees += fee
+			if !chain.Params.MoneyRange(fees) {
+				return reject(block.Hash, RejectInvalidTransaction, "fees add up to more than %d", chain.Params.MaxSupply)
+			}
+		}else {
+			if _, err := chain.checkValues(tx, prevTxs); err != nil {
+				return reject(block.Hash, RejectInvalidTransaction, "transaction %x: %s", tx.ID, err)
+			}
+			coinbase = tx
+		}
+
+		seen[txID] = true
+		prevTxs[txID] = *tx
+		prevHeights[txID] = block.Height
+	}
+
+	if claimed, allowed := coinbase.OutputValue(), chain.Params.BlockSubsidy(block.Height)+fees; claimed > allowed || !chain.Params.MoneyRange(claimed) {
+		return reject(block.Hash, RejectBadCoinbase, "coinbase pays %d, only %d is allowed", claimed, allowed)
+	}
+
+	return nil
+}
+
+
+// checkValues returns the fee of tx. Every output, and the running sums of the
+// inputs and outputs, have to stay within MaxSupply so that no sum can wrap.
+// The outputs tx spends have to be in prevTxs.
+func (chain *BlockChain) checkValues(tx *Transaction, prevTxs map[string]Transaction) (int, error) {
+	params := chain.Params
+	outputs := 0
+
+	for _, output := range tx.Outputs {
+		if output.Value <= 0 || !params.MoneyRange(output.Value) {
+			return 0, fmt.Errorf("output value %d is out of range", output.Value)
+		}
+		outputs += output.Value
+		if !params.MoneyRange(outputs) {
+			return 0, fmt.Errorf("outputs add up to more than %d", params.MaxSupply)
+		}
+	}
+
+	if tx.IsCoinbase() {
+		return 0, nil
+	}
+
+	inputs := 0
+
+	for _, input := range tx.Inputs {
+		value := prevTxs[hex.EncodeToString(input.ID)].Outputs[input.Out].Value
+		if value <= 0 || !params.MoneyRange(value) {
+			return 0, fmt.Errorf("input %x:%d value %d is out of range", input.ID, input.Out, value)
+		}
+		inputs += value
+		if !params.MoneyRange(inputs) {
+			return 0, fmt.Errorf("inputs add up to more than %d", params.MaxSupply)
+		}
+	}
+
+	if inputs < outputs {
+		return 0, fmt.Errorf("spends more than its inputs")
+	}
+
+	return inputs - outputs, nil
+}
+
+
+// findBranchInputs walks back the branch a block extends and collects the
+// transactions its inputs refer to, with the heights they were included at.
+// It fails if one of the spent outputs was already spent on that branch or
+// within the block itself.
+func (chain *BlockChain) findBranchInputs(block *Block) (map[string]Transaction, map[string]int, error) {
+	prevTxs := make(map[string]Transaction)
+	prevHeights := make(map[string]int)
+	needed := make(map[string]bool)
+	spent := make(map[string]bool)
+	inBlock := make(map[string]bool)
+
+	for _, tx := range block.Transactions {
+		if !tx.IsCoinbase() {
+			for _, input := range tx.Inputs {
+				outpoint := fmt.Sprintf("%x:%d", input.ID, input.Out)
+				if spent[outpoint] {
+					return nil, nil, reject(block.Hash, RejectInvalidTransaction, "output %s is spent twice in the block", outpoint)
+				}
+				spent[outpoint] = true
+
+				inputID := hex.EncodeToString(input.ID)
+				if !inBlock[inputID] {
+					needed[inputID] = true
+				}
+			}
+		}
+		inBlock[hex.EncodeToString(tx.ID)] = true
+	}
+
+	spentOnBranch := make(map[string]bool)
+	iter := &BlockChainIterator{block.PrevHash, chain}
+	var walked []*Block
+
+	for len(needed) > 0 {
+		branchBlock, err := iter.Next()
+		if errors.Is(err, ErrBlockPruned) {
+			if err := chain.prunedInputs(block, walked, needed, prevTxs, prevHeights); err != nil {
+				return nil, nil, err
+			}
+			break
+		}
+		if err != nil {
+			return nil, nil, err
+		}
+		walked = append(walked, branchBlock)
+
+		for _, tx := range branchBlock.Transactions {
+			txID := hex.EncodeToString(tx.ID)
+			if needed[txID] {
+				prevTxs[txID] = *tx
+				prevHeights[txID] = branchBlock.Height
+				delete(needed, txID)
+			}
+
+			if !tx.IsCoinbase() {
+				for _, input := range tx.Inputs {
+					spentOnBranch[fmt.Sprintf("%x:%d", input.ID, input.Out)] = true
+				}
+			}
+		}
+
+		if len(branchBlock.PrevHash) == 0 {
+			break
+		}
+	}
+
+	for outpoint := range spent {
+		if spentOnBranch[outpoint] {
+			return nil, nil, reject(block.Hash, RejectInvalidTransaction, "output %s is already spent", outpoint)
+		}
+	}
+
+	return prevTxs, prevHeights, nil
+}
+
+
+// unsignedHash is the transaction id: the hash of the transaction before its
+// inputs were signed.
+func unsignedHash(tx *Transaction) []byte {
+	txCopy := *tx
+	txCopy.Inputs = make([]TxInput, len(tx.Inputs))
+
+	for index, input := range tx.Inputs {
+		txCopy.Inputs[index] = TxInput{input.ID, input.Out, nil, input.PubKey}
+	}
+
+	return txCopy.Hash()
+}
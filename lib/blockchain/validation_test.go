@@ -0,0 +1,125 @@
+package blockchain
+
+import (
+	"bytes"
+	"errors"
+	"math/big"
+	"testing"
+	"time"
+)
+
+// RejectBadSeal comes from the proof of authority engine, poa_test.go covers
+// it.
+func TestRejectCodes(t *testing.T) {
+	tests := []struct {
+		name						string
+		code						RejectCode
+		// build returns an invalid block on top of parent
+		build						func(t *testing.T, chain *BlockChain, parent *Block, address string) *Block
+	}{
+		{"hash", RejectInvalidHash, func(t *testing.T, chain *BlockChain, parent *Block, address string) *Block {
+			block := sealBlock(t, chain, parent, []*Transaction{coinbaseTx(t, address, 20)}, nil)
+			block.Hash = bytes.Repeat([]byte{0xee}, 32)
+			return block
+		}},
+		{"proof of work", RejectProofOfWork, func(t *testing.T, chain *BlockChain, parent *Block, address string) *Block {
+			block := sealBlock(t, chain, parent, []*Transaction{coinbaseTx(t, address, 20)}, nil)
+			for NewProof(&block.BlockHeader).Validate() {
+				block.Nonce++
+			}
+			block.Hash = block.BlockHeader.Hash()
+			return block
+		}},
+		{"unknown parent", RejectUnknownParent, func(t *testing.T, chain *BlockChain, parent *Block, address string) *Block {
+			return sealBlock(t, chain, parent, []*Transaction{coinbaseTx(t, address, 20)}, func(header *BlockHeader) {
+				header.PrevHash = bytes.Repeat([]byte{0xab}, 32)
+			})
+		}},
+		{"height", RejectBadHeight, func(t *testing.T, chain *BlockChain, parent *Block, address string) *Block {
+			return sealBlock(t, chain, parent, []*Transaction{coinbaseTx(t, address, 20)}, func(header *BlockHeader) {
+				header.Height += 1
+			})
+		}},
+		{"difficulty", RejectBadDifficulty, func(t *testing.T, chain *BlockChain, parent *Block, address string) *Block {
+			// harder than required still has to match
+			return sealBlock(t, chain, parent, []*Transaction{coinbaseTx(t, address, 20)}, func(header *BlockHeader) {
+				header.Bits = BigToCompact(new(big.Int).Rsh(chain.Params.PowLimit, 1))
+			})
+		}},
+		{"merkle root", RejectBadMerkleRoot, func(t *testing.T, chain *BlockChain, parent *Block, address string) *Block {
+			return sealBlock(t, chain, parent, []*Transaction{coinbaseTx(t, address, 20)}, func(header *BlockHeader) {
+				header.MerkleRoot = make([]byte, 32)
+			})
+		}},
+		{"coinbase", RejectBadCoinbase, func(t *testing.T, chain *BlockChain, parent *Block, address string) *Block {
+			return sealBlock(t, chain, parent, []*Transaction{coinbaseTx(t, address, 21)}, nil)
+		}},
+		{"transaction", RejectInvalidTransaction, func(t *testing.T, chain *BlockChain, parent *Block, address string) *Block {
+			tx := &Transaction{nil, []TxInput{{bytes.Repeat([]byte{0xcd}, 32), 0, nil, nil}}, []TxOutput{output(t, address, 1)}}
+			tx.ID = tx.Hash()
+			return sealBlock(t, chain, parent, []*Transaction{coinbaseTx(t, address, 20), tx}, nil)
+		}},
+		{"checkpoint", RejectCheckpoint, func(t *testing.T, chain *BlockChain, parent *Block, address string) *Block {
+			chain.Params.Checkpoints = []Checkpoint{{parent.Height + 1, bytes.Repeat([]byte{0x01}, 32)}}
+			return sealBlock(t, chain, parent, []*Transaction{coinbaseTx(t, address, 20)}, nil)
+		}},
+		{"size", RejectBlockTooLarge, func(t *testing.T, chain *BlockChain, parent *Block, address string) *Block {
+			chain.Params.MaxBlockSize = 100
+			return sealBlock(t, chain, parent, []*Transaction{coinbaseTx(t, address, 20)}, nil)
+		}},
+		{"signature checks", RejectBlockTooLarge, func(t *testing.T, chain *BlockChain, parent *Block, address string) *Block {
+			chain.Params.MaxBlockSigOps = 1
+			prevID := bytes.Repeat([]byte{0xcd}, 32)
+			tx := &Transaction{nil, []TxInput{{prevID, 0, nil, nil}, {prevID, 1, nil, nil}}, []TxOutput{output(t, address, 1)}}
+			tx.ID = tx.Hash()
+			return sealBlock(t, chain, parent, []*Transaction{coinbaseTx(t, address, 20), tx}, nil)
+		}},
+		{"median time", RejectBadTimestamp, func(t *testing.T, chain *BlockChain, parent *Block, address string) *Block {
+			return sealBlock(t, chain, parent, []*Transaction{coinbaseTx(t, address, 20)}, func(header *BlockHeader) {
+				header.TimeStamp = parent.TimeStamp
+			})
+		}},
+		{"future time", RejectBadTimestamp, func(t *testing.T, chain *BlockChain, parent *Block, address string) *Block {
+			block := sealBlock(t, chain, parent, []*Transaction{coinbaseTx(t, address, 20)}, func(header *BlockHeader) {
+				header.TimeStamp = parent.TimeStamp + chain.Params.MaxFutureDrift + 60
+			})
+			chain.Clock = &testClock{now: time.Unix(parent.TimeStamp, 0)}
+			return block
+		}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			chain, miner := newTestChain(t, testParams())
+			parent := tipBlock(t, chain)
+			block := test.build(t, chain, parent, string(miner.Address()))
+
+			err := chain.AddBlock(block)
+			if code := rejectCode(err); code != test.code {
+				t.Fatalf("got %v, want reject code %s", err, test.code)
+			}
+			if !errors.Is(err, ErrInvalidBlock) {
+				t.Fatalf("%v does not match ErrInvalidBlock", err)
+			}
+			if !bytes.Equal(chain.Tip(), parent.Hash) {
+				t.Fatalf("tip moved to %x", chain.Tip())
+			}
+			if _, err := chain.GetBlockHeader(block.Hash); !errors.Is(err, ErrNotFound) {
+				t.Fatalf("rejected block was stored: %v", err)
+			}
+		})
+	}
+}
+
+
+func TestRejectCodeStrings(t *testing.T) {
+	seen := make(map[string]bool)
+
+	for code := RejectInvalidHash; code <= RejectBadTimestamp; code++ {
+		name := code.String()
+		if seen[name] || name == "" {
+			t.Fatalf("code %d has name %q, which is empty or taken", int(code), name)
+		}
+		seen[name] = true
+	}
+}
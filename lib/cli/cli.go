@@ -1,12 +1,17 @@
 package cli
 
 import (
+	"bufio"
+	"context"
+	"encoding/hex"
+	"errors"
 	"flag"
 	"fmt"
 	"log"
 	"os"
 	"runtime"
 	"strconv"
+	"strings"
 	"tensor/lib/blockchain"
 	"tensor/lib/wallet"
 	"tensor/lib/network"
@@ -22,11 +27,23 @@ func (cli *CommandLine) PrintUsage(){
 	fmt.Println("getbalance -address ADDRESS - get the balance from your account")
 	fmt.Println("createblockchain -address ADDRESS - creates a blockchain")
 	fmt.Println("printchain  - Prints the blocks in the chain")
-	fmt.Println("send -from FROM -to To -amount AMOUNT -mine - send amount of money to a user then -mine flag")
+	fmt.Println("getblock -height HEIGHT - Prints the block at HEIGHT in the chain")
+	fmt.Println("send -from FROM -to To -amount AMOUNT -fee FEE -mine - send amount of money to a user, paying FEE to the miner, then -mine flag")
+	fmt.Println("mine -address ADDRESS -count COUNT - Mines COUNT blocks that only pay the block reward to ADDRESS")
 	fmt.Println("createwallet -Creates a new wallet")
 	fmt.Println("listaddresses -lists all the wallets addresses")
 	fmt.Println("reindexutxo -Rebuilds the UTXO set")
-	fmt.Println("startnode -miner ADDRESS - Start a node with ID specified in NODE_ID env. var. -miner enables mining")
+	fmt.Println("reindex-tx -Builds the transaction index and keeps it up to date from then on")
+	fmt.Println("reindex-addr -Builds the address index and keeps it up to date from then on")
+	fmt.Println("exportchain -file FILE -from FROM -to TO - Writes the blocks from height FROM to TO of the chain to a bootstrap file")
+	fmt.Println("importchain -file FILE - Validates and adds the blocks of a bootstrap file, a new chain is started from its genesis block")
+	fmt.Println("prune -depth DEPTH - Deletes the bodies of blocks more than DEPTH below the tip and keeps pruning from then on")
+	fmt.Println("history -address ADDRESS -offset OFFSET -limit LIMIT - Lists the transactions of an address, needs the address index")
+	fmt.Println("supply -Prints the issued supply and the next halving height")
+	fmt.Println("gettxproof -txid TXID - Prints the merkle proof that a transaction is in the chain")
+	fmt.Println("startnode -miner ADDRESS -workers N - Start a node with ID specified in NODE_ID env. var. -miner enables mining on N goroutines")
+	fmt.Println("startnode -light -genesis HASH - Start a light node that syncs headers only and checks proofs for the wallet addresses, starting from the genesis block HASH")
+	fmt.Println("AUTHORITIES=ADDR1,ADDR2 - Use proof of authority, the block at height h is signed by the wallet of address h mod n")
 }
 
 func (cli *CommandLine) ValidateArgs(){
@@ -37,9 +54,28 @@ func (cli *CommandLine) ValidateArgs(){
 }
 
 
-func (cli *CommandLine) StartNode(nodeID, minerAddress string) {
+func (cli *CommandLine) StartNode(nodeID, minerAddress string, workers int, light bool, genesis string) {
 	fmt.Printf("Starting Node %s\n", nodeID)
 
+	if len(genesis) > 0 {
+		hash, err := hex.DecodeString(genesis)
+		if err != nil || len(hash) != 32 {
+			log.Panic("Wrong genesis hash.")
+		}
+		blockchain.DefaultParams.GenesisHash = hash
+	}
+
+	if light {
+		if len(minerAddress) > 0 {
+			log.Panic("A light node can not mine.")
+		}
+		if len(genesis) == 0 {
+			log.Panic("A light node needs the genesis hash to trust.")
+		}
+		network.StartLightServer(nodeID, chainEngine(nodeID, "", 0))
+		return
+	}
+
 	if len(minerAddress) > 0 {
 		if wallet.ValidateAddress(minerAddress) {
 			fmt.Printf("Mining is on. Address to receive rewards: %s\n", minerAddress)
@@ -48,41 +84,213 @@ func (cli *CommandLine) StartNode(nodeID, minerAddress string) {
 		}
 	}
 
-	network.StartServer(nodeID, minerAddress)
+	network.StartServer(nodeID, minerAddress, chainEngine(nodeID, minerAddress, workers))
+}
+
+
+// exitOnError prints err and ends the command, deferred calls still run.
+func exitOnError(err error) {
+	if err != nil {
+		fmt.Println(err)
+		runtime.Goexit()
+	}
+}
+
+
+// chainEngine is the consensus engine chains are built with. Proof of work
+// mines on workers goroutines. Setting AUTHORITIES to comma separated
+// addresses switches to proof of authority, blocks are then signed with the
+// key of signer from the wallet file.
+func chainEngine(nodeID, signer string, workers int) blockchain.Engine {
+	authorities := os.Getenv("AUTHORITIES")
+	if authorities == "" {
+		miner := blockchain.MinerConfig{Workers: workers, OnHashrate: network.PrintHashrate}
+		return blockchain.NewPowEngine(&blockchain.DefaultParams, miner)
+	}
+
+	var key *wallet.Wallet
+	if signer != "" {
+		wallets, err := wallet.CreateWallets(nodeID)
+		exitOnError(err)
+
+		var ok bool
+		if key, ok = wallets.Wallets[signer]; !ok {
+			fmt.Printf("%s is not in the wallet file of node %s\n", signer, nodeID)
+			runtime.Goexit()
+		}
+	}
+
+	engine, err := blockchain.NewPoaEngine(strings.Split(authorities, ","), key)
+	exitOnError(err)
+
+	return engine
+}
+
+
+func continueChain(nodeID string) *blockchain.BlockChain {
+	chain, err := blockchain.ContinueBlockChain(nodeID, chainEngine(nodeID, "", 0))
+	if errors.Is(err, blockchain.ErrNoChain) {
+		fmt.Println("No existing blockchain found. Create one!")
+		runtime.Goexit()
+	}
+	exitOnError(err)
+
+	return chain
 }
 
 
 func (cli *CommandLine) reIndexUtxo(nodeID string) {
-	chain := blockchain.ContinueBlockChain(nodeID)
-	defer chain.Database.Close()
+	chain := continueChain(nodeID)
+	defer chain.Close()
 	UTXOSet := blockchain.UTXOSet{chain}
-	UTXOSet.Reindex()
+	exitOnError(UTXOSet.Reindex())
 
-	count := UTXOSet.CountTransactions()
+	count, err := UTXOSet.CountTransactions()
+	exitOnError(err)
 	fmt.Printf("Done! There are %d Transactions in the UTXO set.\n", count)
 }
 
-func (cli *CommandLine) PrintChain(nodeID string){
+func (cli *CommandLine) reIndexTx(nodeID string) {
+	chain := continueChain(nodeID)
+	defer chain.Close()
 
-	chain := blockchain.ContinueBlockChain(nodeID)
-	defer chain.Database.Close()
+	count, err := chain.ReindexTransactions()
+	exitOnError(err)
+	fmt.Printf("Done! %d Transactions are in the transaction index.\n", count)
+}
 
-	iter := chain.Iterator()
+func (cli *CommandLine) reIndexAddr(nodeID string) {
+	chain := continueChain(nodeID)
+	defer chain.Close()
 
-	for {
-		block := iter.Next()
+	count, err := chain.ReindexAddresses()
+	exitOnError(err)
+	fmt.Printf("Done! %d entries are in the address index.\n", count)
+}
+
+
+// printProgress reports every 100th block of a chain export or import, and
+// the last one.
+func printProgress(verb string, last int) func(height int) {
+	return func(height int) {
+		if height%100 == 0 || height == last {
+			fmt.Printf("%s block %d of %d\n", verb, height, last)
+		}
+	}
+}
+
+
+func (cli *CommandLine) exportChain(path string, from, to int, nodeID string) {
+	chain := continueChain(nodeID)
+	defer chain.Close()
+
+	if to < 0 {
+		height, err := chain.GetBestHeight()
+		exitOnError(err)
+		to = height
+	}
 
-		fmt.Printf("Previous Hash: %x\n", block.PrevHash)
-		fmt.Printf("Hash: %x\n", block.Hash)
+	file, err := os.Create(path)
+	exitOnError(err)
+	defer file.Close()
 
-		pow := blockchain.NewProof(block)
-		fmt.Printf("pow: %s\n", strconv.FormatBool(pow.Validate()))
+	writer := bufio.NewWriter(file)
+	err = chain.ExportChain(writer, from, to, printProgress("Exported", to))
+	if err == nil {
+		err = writer.Flush()
+	}
+	if err != nil {
+		os.Remove(path)
+	}
+	exitOnError(err)
+
+	fmt.Printf("Done! Wrote blocks %d to %d to %s.\n", from, to, path)
+}
+
+
+func (cli *CommandLine) importChain(path, nodeID string) {
+	file, err := os.Open(path)
+	exitOnError(err)
+	defer file.Close()
 
-		for _, tx := range block.Transactions{
-			fmt.Println(tx)
+	bootstrap, err := blockchain.OpenBootstrap(file)
+	exitOnError(err)
+	fmt.Printf("Importing blocks %d to %d\n", bootstrap.First, bootstrap.Last)
+
+	engine := chainEngine(nodeID, "", 0)
+	chain, err := blockchain.ContinueBlockChain(nodeID, engine)
+	if errors.Is(err, blockchain.ErrNoChain) {
+		if bootstrap.First != 0 {
+			fmt.Println("No existing blockchain found, a new one has to be imported from height 0")
+			runtime.Goexit()
 		}
 
-		fmt.Println()
+		genesis, err := bootstrap.Next()
+		exitOnError(err)
+		chain, err = blockchain.InitBlockChainFromGenesis(nodeID, engine, genesis)
+		exitOnError(err)
+		defer chain.Close()
+	}else {
+		exitOnError(err)
+		defer chain.Close()
+	}
+
+	count, err := chain.ImportChain(bootstrap, printProgress("Imported", bootstrap.Last))
+	exitOnError(err)
+
+	height, err := chain.GetBestHeight()
+	exitOnError(err)
+	fmt.Printf("Done! Read %d blocks, the tip is at height %d.\n", count, height)
+}
+
+
+func (cli *CommandLine) prune(depth int, nodeID string) {
+	chain := continueChain(nodeID)
+	defer chain.Close()
+
+	count, err := chain.EnablePruning(depth)
+	exitOnError(err)
+	fmt.Printf("Done! Pruned %d blocks, the last %d are kept.\n", count, depth)
+}
+
+
+func (cli *CommandLine) History(address string, offset, limit int, nodeID string) {
+	if !wallet.ValidateAddress(address) {
+		log.Panic("Invalid address")
+	}
+	chain := continueChain(nodeID)
+	defer chain.Close()
+
+	pubKeyHash := wallet.Base58Decode([]byte(address))
+	pubKeyHash = pubKeyHash[1:len(pubKeyHash) - 4]
+
+	history, err := chain.AddressHistory(pubKeyHash, offset, limit)
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+
+	for _, entry := range history {
+		fmt.Printf("Height: %d  TX: %x  Received: %d  Sent: %d\n", entry.Height, entry.TxID, entry.Received, entry.Sent)
+	}
+}
+
+func (cli *CommandLine) PrintChain(nodeID string){
+
+	chain := continueChain(nodeID)
+	defer chain.Close()
+
+	iter := chain.Iterator()
+
+	for {
+		block, err := iter.Next()
+		if errors.Is(err, blockchain.ErrBlockPruned) {
+			fmt.Println("Older blocks have been pruned")
+			return
+		}
+		exitOnError(err)
+
+		printBlock(chain, block)
 
 		if len(block.PrevHash) == 0 {
 			break
@@ -90,14 +298,93 @@ func (cli *CommandLine) PrintChain(nodeID string){
 	}
 }
 
+
+func (cli *CommandLine) GetBlock(height int, nodeID string) {
+	chain := continueChain(nodeID)
+	defer chain.Close()
+
+	block, err := chain.GetBlockByHeight(height)
+	if errors.Is(err, blockchain.ErrNotFound) {
+		fmt.Printf("No block at height %d\n", height)
+		return
+	}
+	if errors.Is(err, blockchain.ErrBlockPruned) {
+		fmt.Printf("Block at height %d has been pruned\n", height)
+		return
+	}
+	exitOnError(err)
+
+	printBlock(chain, &block)
+}
+
+
+func printBlock(chain *blockchain.BlockChain, block *blockchain.Block) {
+	fmt.Printf("Height: %d\n", block.Height)
+	fmt.Printf("Previous Hash: %x\n", block.PrevHash)
+	fmt.Printf("Hash: %x\n", block.Hash)
+
+	if err := chain.Engine.VerifySeal(chain, &block.BlockHeader); err != nil {
+		fmt.Printf("seal: %s\n", err)
+	}else {
+		fmt.Println("seal: valid")
+	}
+
+	for _, tx := range block.Transactions{
+		fmt.Println(tx)
+	}
+
+	fmt.Println()
+}
+
+func (cli *CommandLine) GetTxProof(txID, nodeID string) {
+	ID, err := hex.DecodeString(txID)
+	if err != nil {
+		fmt.Println("Invalid transaction id")
+		return
+	}
+
+	chain := continueChain(nodeID)
+	defer chain.Close()
+
+	proof, err := chain.GetTxProof(ID)
+	exitOnError(err)
+
+	header, err := chain.GetBlockHeader(proof.BlockHash)
+	exitOnError(err)
+
+	fmt.Printf("Block: %x\n", proof.BlockHash)
+	fmt.Printf("Height: %d\n", header.Height)
+	fmt.Printf("Merkle Root: %x\n", header.MerkleRoot)
+	fmt.Printf("Index: %d\n", proof.Index)
+	for _, hash := range proof.Hashes {
+		fmt.Printf("	%x\n", hash)
+	}
+	fmt.Printf("Transaction: %x\n", proof.Transaction)
+	fmt.Printf("valid: %s\n", strconv.FormatBool(proof.Verify(header.MerkleRoot)))
+}
+
+func (cli *CommandLine) Supply(nodeID string) {
+	chain := continueChain(nodeID)
+	defer chain.Close()
+
+	height, err := chain.GetBestHeight()
+	exitOnError(err)
+	params := chain.Params
+
+	fmt.Printf("Height: %d\n", height)
+	fmt.Printf("Issued supply: %d\n", params.IssuedSupply(height))
+	fmt.Printf("Max supply: %d\n", params.MaxSupply)
+	fmt.Printf("Current subsidy: %d\n", params.BlockSubsidy(height+1))
+	fmt.Printf("Next halving height: %d\n", params.NextHalvingHeight(height))
+}
+
 func (cli *CommandLine) createBlockChain(address, nodeID string) {
 	if !wallet.ValidateAddress(address) {
 		log.Panic("Invalid address")
 	}
-	chain := blockchain.InitBlockChain(address, nodeID)
-	defer chain.Database.Close()
-	UTXOSet := blockchain.UTXOSet{chain}
-	UTXOSet.Reindex()
+	chain, err := blockchain.InitBlockChain(address, nodeID, chainEngine(nodeID, address, 0))
+	exitOnError(err)
+	defer chain.Close()
 	fmt.Println("Finished!")
 }
 
@@ -106,50 +393,52 @@ func (cli *CommandLine) GetBalance(address, nodeID string) {
 	if !wallet.ValidateAddress(address) {
 		log.Panic("Invalid address")
 	}
-	chain :=  blockchain.ContinueBlockChain(nodeID)
+	chain := continueChain(nodeID)
 	UTXOSet := blockchain.UTXOSet{chain}
-	defer chain.Database.Close()
-
-	balance := 0
+	defer chain.Close()
 
 	pubKeyHash := wallet.Base58Decode([]byte(address))
 	pubKeyHash = pubKeyHash[1:len(pubKeyHash) - 4]
 	
-	UTXOs := UTXOSet.FindUnspentTransactions(pubKeyHash)
-	fmt.Println(balance)
-
-	for _, out := range UTXOs{
-		balance += out.Value
-	}
+	balance, immature, err := UTXOSet.Balance(pubKeyHash)
+	exitOnError(err)
 
 
 	fmt.Printf("Balance of %s:  %d\n", address, balance)
+	fmt.Printf("Immature coinbase:  %d\n", immature)
 
 }
 
 
 
-func (cli *CommandLine) Send(from, to string, amount int, nodeID string, mineNow bool) {
+func (cli *CommandLine) Send(from, to string, amount, fee int, nodeID string, mineNow bool) {
 	if !wallet.ValidateAddress(from) {
 		log.Panic("senders address is invalid")
 	}
 	if !wallet.ValidateAddress(to) {
 		log.Panic("receivers address is invalid")
 	}
-	chain := blockchain.ContinueBlockChain(nodeID)
+	chain := continueChain(nodeID)
 	UTXOSet := blockchain.UTXOSet{chain}
-	defer chain.Database.Close()
+	defer chain.Close()
 
 	wallets, err := wallet.CreateWallets(nodeID)
 	HandleError(err, false)
 	wallet := wallets.GetWallet(from)
 
-	tx := blockchain.NewTransaction(&wallet, to, nodeID, amount, &UTXOSet)
+	tx, err := blockchain.NewTransaction(&wallet, to, nodeID, amount, fee, &UTXOSet)
+	exitOnError(err)
 	if mineNow {
-		cbTx := blockchain.CoinbaseTx(from, "")
+		height, err := chain.GetBestHeight()
+		exitOnError(err)
+		subsidy := chain.Params.BlockSubsidy(height+1)
+		cbTx, err := blockchain.CoinbaseTx(from, "", subsidy+fee)
+		exitOnError(err)
 		txs := []*blockchain.Transaction{cbTx, tx}
-		block := chain.MineBlock(txs)
-		UTXOSet.Update(block)
+		// under proof of authority the sender signs the block
+		chain.Engine = chainEngine(nodeID, from, 0)
+		_, err = chain.MineBlock(context.Background(), txs)
+		exitOnError(err)
 	}else{
 		network.SendTx(network.KnownNodes[0], tx)
 		fmt.Println("send tx")
@@ -159,6 +448,33 @@ func (cli *CommandLine) Send(from, to string, amount int, nodeID string, mineNow
 }
 
 
+// Mine seals count blocks that hold a coinbase only, this is how a new chain
+// gets coins that can be spent once they mature.
+func (cli *CommandLine) Mine(address string, count int, nodeID string) {
+	if !wallet.ValidateAddress(address) {
+		log.Panic("Invalid address")
+	}
+	chain := continueChain(nodeID)
+	defer chain.Close()
+
+	// under proof of authority the miner signs the blocks
+	chain.Engine = chainEngine(nodeID, address, 0)
+
+	for i := 0; i < count; i++ {
+		height, err := chain.GetBestHeight()
+		exitOnError(err)
+		cbTx, err := blockchain.CoinbaseTx(address, "", chain.Params.BlockSubsidy(height+1))
+		exitOnError(err)
+
+		block, err := chain.MineBlock(context.Background(), []*blockchain.Transaction{cbTx})
+		exitOnError(err)
+		fmt.Printf("Mined block %d: %x\n", block.Height, block.Hash)
+	}
+
+	fmt.Println("Success!")
+}
+
+
 func (cli *CommandLine) ListAddresses(nodeID string) {
 	wallets, err := wallet.CreateWallets(nodeID)
 	HandleError(err, false)
@@ -192,46 +508,102 @@ func (cli *CommandLine) Run() {
 	getBalanceCmd := flag.NewFlagSet("getbalance", flag.ExitOnError)
 	createBlockchainCmd := flag.NewFlagSet("createblockchain", flag.ExitOnError)
 	sendCmd := flag.NewFlagSet("send", flag.ExitOnError)
+	mineCmd := flag.NewFlagSet("mine", flag.ExitOnError)
 	printChainCmd := flag.NewFlagSet("printChain", flag.ExitOnError)
 	CreateWalletCmd := flag.NewFlagSet("createwallet", flag.ExitOnError)
 	ListAddressesCmd := flag.NewFlagSet("listaddresses", flag.ExitOnError)
 	ReindexUtxocmd  := flag.NewFlagSet("reindexutxo", flag.ExitOnError)
+	ReindexTxCmd := flag.NewFlagSet("reindex-tx", flag.ExitOnError)
+	ReindexAddrCmd := flag.NewFlagSet("reindex-addr", flag.ExitOnError)
+	historyCmd := flag.NewFlagSet("history", flag.ExitOnError)
+	pruneCmd := flag.NewFlagSet("prune", flag.ExitOnError)
+	exportChainCmd := flag.NewFlagSet("exportchain", flag.ExitOnError)
+	importChainCmd := flag.NewFlagSet("importchain", flag.ExitOnError)
 	StartNodecmd  := flag.NewFlagSet("startnode", flag.ExitOnError)
+	SupplyCmd := flag.NewFlagSet("supply", flag.ExitOnError)
+	getBlockCmd := flag.NewFlagSet("getblock", flag.ExitOnError)
+	getTxProofCmd := flag.NewFlagSet("gettxproof", flag.ExitOnError)
 
 	getBalanceAddress := getBalanceCmd.String("address", "", "The address")
 	createBlockchainAddress := createBlockchainCmd.String("address", "", "The address")
 	sendFrom := sendCmd.String("from", "", "source wallet address")
 	sendTo := sendCmd.String("to", "", "destination wallet address")
 	sendAmount := sendCmd.Int("amount", 0, "Amount to send")
+	sendFee := sendCmd.Int("fee", 0, "Fee paid to the miner")
+	mineAddress := mineCmd.String("address", "", "address the block rewards go to")
+	mineCount := mineCmd.Int("count", 1, "blocks to mine")
 	sendMine := sendCmd.Bool("mine", false, "mine emmediately on the same node")
 	startNodeMiner := StartNodecmd.String("miner", "", "enable mining mode and send reward this address")
+	startNodeWorkers := StartNodecmd.Int("workers", 0, "mining goroutines, 0 uses every CPU")
+	startNodeLight := StartNodecmd.Bool("light", false, "sync headers only and check proofs for the wallet addresses")
+	startNodeGenesis := StartNodecmd.String("genesis", "", "hash of the genesis block, required by light nodes")
+	getBlockHeight := getBlockCmd.Int("height", -1, "height of the block")
+	historyAddress := historyCmd.String("address", "", "The address")
+	historyOffset := historyCmd.Int("offset", 0, "transactions to skip")
+	historyLimit := historyCmd.Int("limit", 50, "transactions to list")
+	getTxProofID := getTxProofCmd.String("txid", "", "id of the transaction")
+	exportChainFile := exportChainCmd.String("file", "", "bootstrap file to write")
+	exportChainFrom := exportChainCmd.Int("from", 0, "height of the first block")
+	exportChainTo := exportChainCmd.Int("to", -1, "height of the last block, the tip by default")
+	importChainFile := importChainCmd.String("file", "", "bootstrap file to read")
+	pruneDepth := pruneCmd.Int("depth", blockchain.MinPruneDepth, "blocks to keep below the tip")
 
 	switch os.Args[1]{
 		case "getbalance":
 			err := getBalanceCmd.Parse(os.Args[2:])
-			blockchain.HandleError(err)
+			HandleError(err, false)
 		
 		case "createblockchain":
 			err := createBlockchainCmd.Parse(os.Args[2:])
-			blockchain.HandleError(err)
+			HandleError(err, false)
 		case "printchain":
 			err := printChainCmd.Parse(os.Args[2:])
-			blockchain.HandleError(err)
+			HandleError(err, false)
 		case "send":
 			err := sendCmd.Parse(os.Args[2:])
-			blockchain.HandleError(err)
+			HandleError(err, false)
+		case "mine":
+			err := mineCmd.Parse(os.Args[2:])
+			HandleError(err, false)
 		case "createwallet":
 			err := CreateWalletCmd.Parse(os.Args[2:])
-			blockchain.HandleError(err)
+			HandleError(err, false)
 		case "listaddresses":
 			err := ListAddressesCmd.Parse(os.Args[2:])
-			blockchain.HandleError(err)
+			HandleError(err, false)
 		case "reindexutxo":
 			err := ReindexUtxocmd.Parse(os.Args[2:])
-			blockchain.HandleError(err)
+			HandleError(err, false)
+		case "reindex-tx":
+			err := ReindexTxCmd.Parse(os.Args[2:])
+			HandleError(err, false)
+		case "reindex-addr":
+			err := ReindexAddrCmd.Parse(os.Args[2:])
+			HandleError(err, false)
+		case "history":
+			err := historyCmd.Parse(os.Args[2:])
+			HandleError(err, false)
+		case "prune":
+			err := pruneCmd.Parse(os.Args[2:])
+			HandleError(err, false)
+		case "exportchain":
+			err := exportChainCmd.Parse(os.Args[2:])
+			HandleError(err, false)
+		case "importchain":
+			err := importChainCmd.Parse(os.Args[2:])
+			HandleError(err, false)
 		case "startnode":
 			err := StartNodecmd.Parse(os.Args[2:])
-			blockchain.HandleError(err)
+			HandleError(err, false)
+		case "supply":
+			err := SupplyCmd.Parse(os.Args[2:])
+			HandleError(err, false)
+		case "getblock":
+			err := getBlockCmd.Parse(os.Args[2:])
+			HandleError(err, false)
+		case "gettxproof":
+			err := getTxProofCmd.Parse(os.Args[2:])
+			HandleError(err, false)
 		default:
 			cli.PrintUsage()
 			runtime.Goexit()
@@ -270,7 +642,24 @@ func (cli *CommandLine) Run() {
 			fmt.Println("You cannot send 0 as amount")
 			runtime.Goexit()
 		}
-		cli.Send(*sendFrom, *sendTo, *sendAmount, nodeID, *sendMine)
+		if *sendFee < 0 {
+			fmt.Println("You cannot pay a negative fee")
+			runtime.Goexit()
+		}
+		cli.Send(*sendFrom, *sendTo, *sendAmount, *sendFee, nodeID, *sendMine)
+	}
+
+	if mineCmd.Parsed() {
+		if *mineAddress == "" {
+			fmt.Println("provide an address for the block rewards")
+			runtime.Goexit()
+		}
+		if *mineCount <= 0 {
+			fmt.Println("provide a positive number of blocks")
+			runtime.Goexit()
+		}
+		cli.Mine(*mineAddress, *mineCount, nodeID)
+		runtime.Goexit()
 	}
 
 	if StartNodecmd.Parsed() {
@@ -279,7 +668,7 @@ func (cli *CommandLine) Run() {
 			StartNodecmd.Usage()
 			runtime.Goexit()
 		}
-		cli.StartNode(nodeID, *startNodeMiner)
+		cli.StartNode(nodeID, *startNodeMiner, *startNodeWorkers, *startNodeLight, *startNodeGenesis)
 	}
 
 	if printChainCmd.Parsed() {
@@ -292,6 +681,71 @@ func (cli *CommandLine) Run() {
 		runtime.Goexit()
 	}
 
+	if getBlockCmd.Parsed() {
+		if *getBlockHeight < 0 {
+			fmt.Println("provide the height of the block")
+			runtime.Goexit()
+		}
+		cli.GetBlock(*getBlockHeight, nodeID)
+		runtime.Goexit()
+	}
+
+	if getTxProofCmd.Parsed() {
+		if *getTxProofID == "" {
+			fmt.Println("provide a transaction id")
+			runtime.Goexit()
+		}
+		cli.GetTxProof(*getTxProofID, nodeID)
+		runtime.Goexit()
+	}
+
+	if SupplyCmd.Parsed() {
+		cli.Supply(nodeID)
+		runtime.Goexit()
+	}
+
+	if ReindexTxCmd.Parsed() {
+		cli.reIndexTx(nodeID)
+		runtime.Goexit()
+	}
+
+	if ReindexAddrCmd.Parsed() {
+		cli.reIndexAddr(nodeID)
+		runtime.Goexit()
+	}
+
+	if exportChainCmd.Parsed() {
+		if *exportChainFile == "" {
+			fmt.Println("provide a file to write the chain to")
+			runtime.Goexit()
+		}
+		cli.exportChain(*exportChainFile, *exportChainFrom, *exportChainTo, nodeID)
+		runtime.Goexit()
+	}
+
+	if importChainCmd.Parsed() {
+		if *importChainFile == "" {
+			fmt.Println("provide a bootstrap file to import")
+			runtime.Goexit()
+		}
+		cli.importChain(*importChainFile, nodeID)
+		runtime.Goexit()
+	}
+
+	if pruneCmd.Parsed() {
+		cli.prune(*pruneDepth, nodeID)
+		runtime.Goexit()
+	}
+
+	if historyCmd.Parsed() {
+		if *historyAddress == "" {
+			fmt.Println("provide a wallet address")
+			runtime.Goexit()
+		}
+		cli.History(*historyAddress, *historyOffset, *historyLimit, nodeID)
+		runtime.Goexit()
+	}
+
 	if ListAddressesCmd.Parsed() {
 		cli.ListAddresses(nodeID)
 		runtime.Goexit()
@@ -0,0 +1,261 @@
+package network
+
+import (
+	"bytes"
+	"encoding/gob"
+	"fmt"
+	"net"
+	"tensor/lib/blockchain"
+	"tensor/lib/wallet"
+)
+
+// A light node follows the headers of a full node and asks it for merkle
+// proofs of the transactions that touch the addresses in its wallet file.
+
+var (
+	watchedAddresses []string
+)
+
+type GetHeaders struct {
+	AddressFrom						string
+	Locator							[][]byte
+}
+
+type Headers struct {
+	AddressFrom						string
+	Headers							[][]byte
+}
+
+type Proofs struct {
+	AddressFrom						string
+	Proofs							[][]byte
+}
+
+
+func SendGetHeaders(address string, chain *blockchain.BlockChain) error {
+	locator, err := chain.Locator()
+	if err != nil {
+		return err
+	}
+
+	payload := GobEncode(GetHeaders{nodeAddress, locator})
+	request := append(CmdToBytes("getheaders"), payload...)
+
+	SendData(address, request)
+
+	return nil
+}
+
+
+func SendHeaders(address string, headers []*blockchain.BlockHeader) {
+	var data [][]byte
+
+	for _, header := range headers {
+		data = append(data, blockchain.EncodeHeader(header))
+	}
+
+	payload := GobEncode(Headers{nodeAddress, data})
+	request := append(CmdToBytes("headers"), payload...)
+
+	SendData(address, request)
+}
+
+
+func SendProofs(address string, proofs []*blockchain.MerkleProof) {
+	var data [][]byte
+
+	for _, proof := range proofs {
+		data = append(data, blockchain.EncodeMerkleProof(proof))
+	}
+
+	payload := GobEncode(Proofs{nodeAddress, data})
+	request := append(CmdToBytes("proofs"), payload...)
+
+	SendData(address, request)
+}
+
+
+// RequestProofs asks address for the proofs of every watched address.
+func RequestProofs(address string) {
+	for _, addr := range watchedAddresses {
+		SendGetData(address, "proofs", pubKeyHash(addr))
+	}
+}
+
+
+func pubKeyHash(address string) []byte {
+	fullHash := wallet.Base58Decode([]byte(address))
+
+	return fullHash[1 : len(fullHash)-4]
+}
+
+
+func HandleGetHeaders(request []byte, chain *blockchain.BlockChain) error {
+	var buff bytes.Buffer
+	var payload GetHeaders
+
+	buff .Write(request[commandLength:])
+	if err := gob.NewDecoder(&buff).Decode(&payload); err != nil {
+		return err
+	}
+
+	headers, err := chain.HeadersAfter(payload.Locator, blockchain.MaxHeaders)
+	if err != nil {
+		return err
+	}
+	SendHeaders(payload.AddressFrom, headers)
+
+	return nil
+}
+
+
+func HandleHeaders(request []byte, chain *blockchain.BlockChain) error {
+	var buff bytes.Buffer
+	var payload Headers
+
+	buff .Write(request[commandLength:])
+	if err := gob.NewDecoder(&buff).Decode(&payload); err != nil {
+		return err
+	}
+
+	if len(payload.Headers) > blockchain.MaxHeaders {
+		return fmt.Errorf("%d headers is more than the limit of %d", len(payload.Headers), blockchain.MaxHeaders)
+	}
+
+	if !chain.Light {
+		return handleCheckpointHeaders(payload, chain)
+	}
+
+	for _, data := range payload.Headers {
+		header, err := blockchain.DecodeHeader(data)
+		if err != nil {
+			return err
+		}
+		if err := chain.AddHeader(&header); err != nil {
+			return err
+		}
+	}
+
+	height, err := chain.HeaderHeight()
+	if err != nil {
+		return err
+	}
+	fmt.Printf("Synced headers to height %d\n", height)
+
+	if len(payload.Headers) == blockchain.MaxHeaders {
+		return SendGetHeaders(payload.AddressFrom, chain)
+	}
+
+	RequestProofs(payload.AddressFrom)
+
+	return nil
+}
+
+
+// handleCheckpointHeaders takes the headers a full node asked for on its way
+// to the last checkpoint, the blocks are fetched once they reach it or the
+// peer has no more.
+func handleCheckpointHeaders(payload Headers, chain *blockchain.BlockChain) error {
+	var headers []*blockchain.BlockHeader
+
+	for _, data := range payload.Headers {
+		header, err := blockchain.DecodeHeader(data)
+		if err != nil {
+			return err
+		}
+		headers = append(headers, &header)
+	}
+
+	synced, err := chain.AddCheckpointHeaders(headers)
+	if err != nil {
+		return err
+	}
+	if !synced && len(payload.Headers) == blockchain.MaxHeaders {
+		return SendGetHeaders(payload.AddressFrom, chain)
+	}
+
+	SendGetBlocks(payload.AddressFrom)
+
+	return nil
+}
+
+
+func HandleProofs(request []byte, chain *blockchain.BlockChain) error {
+	var buff bytes.Buffer
+	var payload Proofs
+
+	buff .Write(request[commandLength:])
+	if err := gob.NewDecoder(&buff).Decode(&payload); err != nil {
+		return err
+	}
+
+	for _, data := range payload.Proofs {
+		proof, err := blockchain.DecodeMerkleProof(data)
+		if err != nil {
+			return err
+		}
+
+		tx, err := chain.AddProof(&proof)
+		if err != nil {
+			return err
+		}
+		fmt.Printf("Proved transaction %x in block %x\n", tx.ID, proof.BlockHash)
+	}
+
+	for _, addr := range watchedAddresses {
+		balance, err := chain.ProvenBalance(pubKeyHash(addr))
+		if err != nil {
+			return err
+		}
+		fmt.Printf("Balance of %s: %d\n", addr, balance)
+	}
+
+	return nil
+}
+
+
+// lightCommand reports whether a light node answers command, it has no
+// blocks or mempool to serve.
+func lightCommand(command string) bool {
+	switch command {
+		case "version", "inv", "headers", "proofs":
+			return true
+	}
+
+	return false
+}
+
+
+// StartLightServer syncs headers from the first known node and watches the
+// addresses in the wallet file of nodeID.
+func StartLightServer(nodeID string, engine blockchain.Engine) {
+	nodeAddress = fmt.Sprintf("localhost:%s", nodeID)
+
+	if wallets, err := wallet.CreateWallets(nodeID); err == nil {
+		watchedAddresses = wallets.GetAllAddresses()
+	}else {
+		fmt.Println("No wallets loaded, syncing headers only:", err)
+	}
+
+	ln, err := net.Listen(protocol, nodeAddress)
+	HandleError(err)
+
+	defer ln.Close()
+
+	chain, err := blockchain.OpenLightChain(nodeID, engine)
+	HandleError(err)
+	defer chain.Close()
+	go CloseDB(chain)
+
+	fmt.Printf("Watching %d addresses\n", len(watchedAddresses))
+	HandleError(SendVersion(KnownNodes[0], chain))
+
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			fmt.Println(err)
+			continue
+		}
+		go HandleConnection(conn, chain)
+	}
+}
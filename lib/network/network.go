@@ -2,8 +2,10 @@ package network
 
 import (
 	"bytes"
+	"context"
 	"encoding/gob"
 	"encoding/hex"
+	"errors"
 	"fmt"
 	"io"
 	"io/ioutil"
@@ -11,6 +13,8 @@ import (
 	"net"
 	"os"
 	"runtime"
+	"sort"
+	"sync"
 	"syscall"
 	"tensor/lib/blockchain"
 
@@ -21,14 +25,27 @@ const (
 	protocol = "tcp"
 	version = 1
 	commandLength = 12
+	// largest request read from a peer, room for a full block with the
+	// envelope around it
+	maxMessageSize = 4 << 20
 )
 
 var (
 	nodeAddress string
 	minerAddress string
 	KnownNodes  = []string{"localhost:3000"}
+	// blocksInTransit is shared by the connection handlers, hold transitMutex
 	blocksInTransit [][]byte
+	transitMutex sync.Mutex
+	// memoryPool is shared by the connection handlers, hold poolMutex
 	memoryPool = make(map[string]blockchain.Transaction)
+	poolMutex sync.Mutex
+
+	// cancelMining stops the block being mined, if any. mining is set while
+	// MineTx runs, only one job mines at a time
+	cancelMining context.CancelFunc
+	mining bool
+	miningMutex sync.Mutex
 )
 
 type Address struct {
@@ -65,6 +82,11 @@ type Version struct {
 	Version							int
 	BestHeight						int
 	AddressFrom						string
+	// Light nodes sync headers only and are not asked for blocks
+	Light							bool
+	// height of the oldest block the node can serve, pruned nodes deleted
+	// the ones below it
+	LowestBlock						int
 }
 
 
@@ -143,12 +165,21 @@ func SendTx(address string, txn *blockchain.Transaction) {
 }
 
 
-func SendVersion(address string, chain *blockchain.BlockChain) {
-	bestHeight := chain.GetBestHeight()
-	payload := GobEncode(Version{version, bestHeight, nodeAddress})
+func SendVersion(address string, chain *blockchain.BlockChain) error {
+	bestHeight, err := chain.HeaderHeight()
+	if err != nil {
+		return err
+	}
+	prunedHeight, err := chain.PrunedHeight()
+	if err != nil {
+		return err
+	}
+	payload := GobEncode(Version{version, bestHeight, nodeAddress, chain.Light, prunedHeight + 1})
 	request := append(CmdToBytes("version"), payload...)
 
 	SendData(address, request)
+
+	return nil
 }
 
 
@@ -169,113 +200,183 @@ func SendGetData(address, kind string, id []byte) {
 
 
 
-func HandleAddress(request []byte){
+func HandleAddress(request []byte) error {
 	var buff bytes.Buffer
 	var payload Address
 
 	buff .Write(request[commandLength:])
-	err := gob.NewDecoder(&buff).Decode(&payload)
-	HandleError(err)
+	if err := gob.NewDecoder(&buff).Decode(&payload); err != nil {
+		return err
+	}
 
 	KnownNodes = append(KnownNodes, payload.AddressList...)
 	fmt.Printf("there are %d known nodes\n", len(KnownNodes))
 	RequestBlocks()
+
+	return nil
 }
 
 
 
 
-func HandleInv(request []byte, chain *blockchain.BlockChain) {
+func HandleInv(request []byte, chain *blockchain.BlockChain) error {
 	var buff bytes.Buffer
 	var payload Inv
 
 	buff .Write(request[commandLength:])
-	err := gob.NewDecoder(&buff).Decode(&payload)
-	HandleError(err)
+	if err := gob.NewDecoder(&buff).Decode(&payload); err != nil {
+		return err
+	}
 
 	fmt.Printf("Received inventory with %d %s\n", len(payload.Items), payload.Type)
 
-	if payload.Type == "block" {
-		blocksInTransit = payload.Items
-
-		blockHash := payload.Items[0]
-		SendGetData(payload.AddressFrom, "block", blockHash)
-
-		newInTransit := [][]byte{}
+	if chain.Light {
+		if payload.Type == "block" {
+			return SendGetHeaders(payload.AddressFrom, chain)
+		}
+		return nil
+	}
 
-		for _, block := range blocksInTransit {
-			if bytes.Compare(block, blockHash) != 0 {
-				newInTransit = append(newInTransit, block)
+	if payload.Type == "block" {
+		var missing [][]byte
+
+		// inventories list the tip first, parents have to be requested first
+		for i := len(payload.Items) - 1; i >= 0; i-- {
+			_, err := chain.GetBlockHeader(payload.Items[i])
+			if errors.Is(err, blockchain.ErrNotFound) {
+				missing = append(missing, payload.Items[i])
+			}else if err != nil {
+				return err
 			}
 		}
-		blocksInTransit = newInTransit
+
+		if len(missing) == 0 {
+			setInTransit(nil)
+			return nil
+		}
+
+		setInTransit(missing[1:])
+		SendGetData(payload.AddressFrom, "block", missing[0])
 	}
 
-	if payload.Type == "tx" {
+	if payload.Type == "tx" && len(payload.Items) > 0 {
 		txID := payload.Items[0]
 
-		if memoryPool[hex.EncodeToString(txID)].ID == nil {
+		poolMutex.Lock()
+		_, known := memoryPool[hex.EncodeToString(txID)]
+		poolMutex.Unlock()
+
+		if !known {
 			SendGetData(payload.AddressFrom, "tx", txID)
 		}
 	}
+
+	return nil
 }
 
 
 
 
 
-func HandleBlock(request []byte, chain *blockchain.BlockChain) {
+func HandleBlock(request []byte, chain *blockchain.BlockChain) error {
 	var buff bytes.Buffer
 	var payload Block
 
 	buff .Write(request[commandLength:])
-	err := gob.NewDecoder(&buff).Decode(&payload)
-	HandleError(err)
+	if err := gob.NewDecoder(&buff).Decode(&payload); err != nil {
+		return err
+	}
 
 	blockdata := payload.Block
-	block := blockchain.Deserialize(blockdata)
+	if len(blockdata) > chain.Params.MaxBlockSize {
+		return fmt.Errorf("block of %d bytes is over the limit of %d", len(blockdata), chain.Params.MaxBlockSize)
+	}
+	// peers send the current encoding only, gob is read from old databases
+	block, err := blockchain.DecodeBlock(blockdata)
+	if err != nil {
+		return err
+	}
 
 	fmt.Println("Received a new block!")
-	chain.AddBlock(block) 
+	lastHash := chain.Tip()
+	if err := chain.AddBlock(&block); err != nil {
+		setInTransit(nil)
+		return err
+	}
 
 	fmt.Printf("Added block %x\n", block.Hash)
 
-	if len(blocksInTransit) > 0 {
-		blockHash := blocksInTransit[0]
+	if !bytes.Equal(lastHash, chain.Tip()) {
+		StopMining()
+	}
+
+	if blockHash := nextInTransit(); blockHash != nil {
 		SendGetData(payload.AddressFrom, "block", blockHash)
+	}
 
-		blocksInTransit = blocksInTransit[1:]
-	}else {
-		UTXOSet := blockchain.UTXOSet{chain}
-		UTXOSet.Reindex()
+	return nil
+}
+
+
+func setInTransit(hashes [][]byte) {
+	transitMutex.Lock()
+	blocksInTransit = hashes
+	transitMutex.Unlock()
+}
+
+
+// nextInTransit takes the next block to request off the list, nil when there
+// is none.
+func nextInTransit() []byte {
+	transitMutex.Lock()
+	defer transitMutex.Unlock()
+
+	if len(blocksInTransit) == 0 {
+		return nil
 	}
+	blockHash := blocksInTransit[0]
+	blocksInTransit = blocksInTransit[1:]
+
+	return blockHash
 }
 
 
-func HandleGetBlocks(request []byte, chain *blockchain.BlockChain) {
+func HandleGetBlocks(request []byte, chain *blockchain.BlockChain) error {
 	var buff bytes.Buffer
 	var payload GetBlocks
 
 	buff .Write(request[commandLength:])
-	err := gob.NewDecoder(&buff).Decode(&payload)
-	HandleError(err)
+	if err := gob.NewDecoder(&buff).Decode(&payload); err != nil {
+		return err
+	}
 
-	blocks := chain.GetBlockHashes()
+	// pruned blocks can not be served, they are left out
+	prunedHeight, err := chain.PrunedHeight()
+	if err != nil {
+		return err
+	}
+	blocks, err := chain.GetBlockHashes(prunedHeight + 1)
+	if err != nil {
+		return err
+	}
 	SendInv(payload.AddressFrom, "block", blocks)
+
+	return nil
 }
 
-func HandleGetData(request []byte, chain *blockchain.BlockChain) {
+func HandleGetData(request []byte, chain *blockchain.BlockChain) error {
 	var buff bytes.Buffer
 	var payload GetData
 
 	buff .Write(request[commandLength:])
-	err := gob.NewDecoder(&buff).Decode(&payload)
-	HandleError(err)
+	if err := gob.NewDecoder(&buff).Decode(&payload); err != nil {
+		return err
+	}
 
 	if payload.Type == "block" {
 		block, err := chain.GetBlock([]byte(payload.ID))
 		if err != nil {
-			return
+			return err
 		}
 
 		SendBlock(payload.AddressFrom, &block)
@@ -283,49 +384,109 @@ func HandleGetData(request []byte, chain *blockchain.BlockChain) {
 
 	if payload.Type == "tx" {
 		txID := hex.EncodeToString(payload.ID)
-		tx := memoryPool[txID]
+		poolMutex.Lock()
+		tx, ok := memoryPool[txID]
+		poolMutex.Unlock()
 
-		SendTx(payload.AddressFrom, &tx)
+		if ok {
+			SendTx(payload.AddressFrom, &tx)
+		}
+	}
+
+	if payload.Type == "proofs" {
+		proofs, err := chain.AddressProofs(payload.ID)
+		if err != nil {
+			return err
+		}
+
+		SendProofs(payload.AddressFrom, proofs)
 	}
+
+	return nil
 }
 
 
-func HandleVersion(request []byte, chain *blockchain.BlockChain) {
+func HandleVersion(request []byte, chain *blockchain.BlockChain) error {
 	var buff bytes.Buffer
 	var payload Version
 
 	buff .Write(request[commandLength:])
-	err := gob.NewDecoder(&buff).Decode(&payload)
-	HandleError(err)
+	if err := gob.NewDecoder(&buff).Decode(&payload); err != nil {
+		return err
+	}
 
-	bestHeight := chain.GetBestHeight()
+	bestHeight, err := chain.HeaderHeight()
+	if err != nil {
+		return err
+	}
 	otherHeight := payload.BestHeight
 
-	if bestHeight < otherHeight {
-		SendGetBlocks(payload.AddressFrom)
+	if chain.Light {
+		if bestHeight < otherHeight {
+			return SendGetHeaders(payload.AddressFrom, chain)
+		}
+		RequestProofs(payload.AddressFrom)
+		return nil
+	}
+
+	if payload.Light {
+		// light nodes only ask once, answer so they can start syncing
+		if err := SendVersion(payload.AddressFrom, chain); err != nil {
+			return err
+		}
+	}else if bestHeight < otherHeight {
+		synced, err := chain.CheckpointSynced()
+		if err != nil {
+			return err
+		}
+
+		if payload.LowestBlock > bestHeight+1 {
+			fmt.Printf("%s has pruned the blocks below height %d, not syncing from it\n", payload.AddressFrom, payload.LowestBlock)
+		}else if !synced {
+			// the headers up to the last checkpoint come first
+			if err := SendGetHeaders(payload.AddressFrom, chain); err != nil {
+				return err
+			}
+		}else {
+			SendGetBlocks(payload.AddressFrom)
+		}
 	}else if bestHeight > otherHeight {
-		SendVersion(payload.AddressFrom, chain)
+		if err := SendVersion(payload.AddressFrom, chain); err != nil {
+			return err
+		}
 	}
 
 	if !NodeIsKnown(payload.AddressFrom) {
 		KnownNodes = append(KnownNodes, payload.AddressFrom)
 	}
+
+	return nil
 }
 
 
-func HandleTx(request []byte, chain *blockchain.BlockChain) {
+func HandleTx(request []byte, chain *blockchain.BlockChain) error {
 	var buff bytes.Buffer
 	var payload Tx
 
 	buff .Write(request[commandLength:])
-	err := gob.NewDecoder(&buff).Decode(&payload)
-	HandleError(err)
+	if err := gob.NewDecoder(&buff).Decode(&payload); err != nil {
+		return err
+	}
 
 	txData := payload.Transaction
-	tx := blockchain.DeserializeTransaction(txData)
+	if len(txData) > chain.Params.MaxBlockSize {
+		return fmt.Errorf("transaction of %d bytes can never fit in a block", len(txData))
+	}
+	tx, err := blockchain.DeserializeTransaction(txData)
+	if err != nil {
+		return err
+	}
+	poolMutex.Lock()
 	memoryPool[hex.EncodeToString(tx.ID)] = tx
+	poolSize := len(memoryPool)
+	poolMutex.Unlock()
 
-	fmt.Printf("%s, %d", nodeAddress, len(memoryPool))
+	fmt.Printf("%s, %d", nodeAddress, poolSize)
 
 	if nodeAddress == KnownNodes[0] {
 		for _, node := range KnownNodes {
@@ -334,41 +495,160 @@ func HandleTx(request []byte, chain *blockchain.BlockChain) {
 			}
 		}
 	}else {
-		if len(memoryPool) >= 2 && len(minerAddress) > 0 {
-			MineTx(chain)
+		if poolSize >= 2 && len(minerAddress) > 0 {
+			return MineTx(chain)
+		}
+	}
+
+	return nil
+}
+
+
+// MineTx mines the memory pool, best fee per byte first, until it is empty.
+// What does not fit in a block stays in the pool for the next one. If a job is
+// already mining it picks up the pool, and MineTx returns at once.
+func MineTx(chain *blockchain.BlockChain) error {
+	miningMutex.Lock()
+	if mining {
+		miningMutex.Unlock()
+		return nil
+	}
+	mining = true
+	miningMutex.Unlock()
+
+	for {
+		mined, err := mineBlock(chain)
+
+		// a transaction added before the flag is cleared is seen here, one
+		// added after starts a new job
+		miningMutex.Lock()
+		poolMutex.Lock()
+		remaining := len(memoryPool)
+		poolMutex.Unlock()
+
+		if err != nil || !mined || remaining == 0 {
+			mining = false
+			miningMutex.Unlock()
+			return err
 		}
+		miningMutex.Unlock()
 	}
 }
 
 
-func MineTx(chain *blockchain.BlockChain) {
+// mineBlock mines one block from the memory pool, it reports false when no
+// block was mined.
+func mineBlock(chain *blockchain.BlockChain) (bool, error) {
+	type candidate struct {
+		tx						*blockchain.Transaction
+		fee						int
+	}
+	var candidates []candidate
 	var txs []*blockchain.Transaction
+	fees := 0
+	// outputs spent by the transactions taken so far
+	spent := make(map[string]bool)
+
+	for id, tx := range poolTransactions() {
+		fmt.Printf("tx: %s\n", tx.ID)
+		if err := chain.VerifyTransaction(&tx); err != nil {
+			fmt.Println(err)
+			removeFromPool(id)
+			continue
+		}
 
-	for id := range memoryPool {
-		fmt.Printf("tx: %s\n", memoryPool[id].ID)
-		tx := memoryPool[id]
-		if chain.VerifyTransaction(&tx){
-			txs = append(txs, &tx)
+		fee, err := chain.TransactionFee(&tx)
+		if err != nil {
+			return false, err
+		}
+		candidates = append(candidates, candidate{&tx, fee})
+	}
+
+	sort.Slice(candidates, func(i, j int) bool {
+		return candidates[i].fee*candidates[j].tx.Size() > candidates[j].fee*candidates[i].tx.Size()
+	})
+
+	bestHeight, err := chain.GetBestHeight()
+	if err != nil {
+		return false, err
+	}
+
+	// the coinbase is only known once the fees are, one with the same size
+	// holds its place in the block
+	subsidy := chain.Params.BlockSubsidy(bestHeight+1)
+	cbtx, err := blockchain.CoinbaseTx(minerAddress, "", subsidy)
+	if err != nil {
+		return false, err
+	}
+
+	budget := blockchain.NewBlockBudget(chain.Params)
+	if err := budget.Add(cbtx); err != nil {
+		return false, err
+	}
+
+	for _, candidate := range candidates {
+		if conflicts(candidate.tx, spent) {
+			continue
+		}
+		if err := budget.Add(candidate.tx); err != nil {
+			if len(txs) == 0 {
+				// too big even for an empty block
+				fmt.Printf("tx %x: %s\n", candidate.tx.ID, err)
+				removeFromPool(hex.EncodeToString(candidate.tx.ID))
+			}
+			continue
+		}
+		txs = append(txs, candidate.tx)
+		fees += candidate.fee
+		for _, input := range candidate.tx.Inputs {
+			spent[fmt.Sprintf("%x:%d", input.ID, input.Out)] = true
 		}
 	}
 
 	if len(txs) == 0 {
-		fmt.Println("All Transactions are invalid")
-		return
+		fmt.Println("No transactions to mine")
+		return false, nil
 	}
 
-	cbtx := blockchain.CoinbaseTx(minerAddress, "")
+	cbtx.Outputs[0].Value = subsidy + fees
+	cbtx.ID = cbtx.Hash()
 	txs = append(txs, cbtx)
 
-	newBlock := chain.MineBlock(txs)
-	UTXOSet := blockchain.UTXOSet{chain}
-	UTXOSet.Reindex()
+	ctx, cancel := context.WithCancel(context.Background())
+	miningMutex.Lock()
+	cancelMining = cancel
+	miningMutex.Unlock()
+
+	newBlock, err := chain.MineBlock(ctx, txs)
+
+	miningMutex.Lock()
+	cancelMining = nil
+	miningMutex.Unlock()
+	cancel()
+
+	if errors.Is(err, context.Canceled) {
+		fmt.Println("Mining stopped, the tip changed")
+		return false, nil
+	}
+	if errors.Is(err, blockchain.ErrNotInTurn) {
+		fmt.Println("Waiting for our turn to sign:", err)
+		return false, nil
+	}
+	if errors.Is(err, blockchain.ErrInvalidBlock) || errors.Is(err, blockchain.ErrInvalidTransaction) {
+		// the same transactions would be rejected again on every attempt
+		for _, tx := range txs {
+			removeFromPool(hex.EncodeToString(tx.ID))
+		}
+		return false, err
+	}
+	if err != nil {
+		return false, err
+	}
 
 	fmt.Println("New Block mined")
 
 	for _, tx := range txs {
-		txID := hex.EncodeToString(tx.ID)
-		delete(memoryPool, txID)
+		removeFromPool(hex.EncodeToString(tx.ID))
 	}
 
 	for _, node := range KnownNodes {
@@ -377,9 +657,57 @@ func MineTx(chain *blockchain.BlockChain) {
 		}
 	}
 
-	if len(memoryPool) > 0 {
-		MineTx(chain)
+	return true, nil
+}
+
+
+// poolTransactions copies the memory pool, keyed by transaction ID.
+func poolTransactions() map[string]blockchain.Transaction {
+	poolMutex.Lock()
+	defer poolMutex.Unlock()
+
+	txs := make(map[string]blockchain.Transaction, len(memoryPool))
+	for id, tx := range memoryPool {
+		txs[id] = tx
 	}
+
+	return txs
+}
+
+
+func removeFromPool(txID string) {
+	poolMutex.Lock()
+	delete(memoryPool, txID)
+	poolMutex.Unlock()
+}
+
+
+// conflicts reports whether tx spends one of the outputs in spent.
+func conflicts(tx *blockchain.Transaction, spent map[string]bool) bool {
+	for _, input := range tx.Inputs {
+		if spent[fmt.Sprintf("%x:%d", input.ID, input.Out)] {
+			return true
+		}
+	}
+
+	return false
+}
+
+
+// StopMining abandons the block being mined, its transactions stay in the
+// memory pool.
+func StopMining() {
+	miningMutex.Lock()
+	defer miningMutex.Unlock()
+
+	if cancelMining != nil {
+		cancelMining()
+	}
+}
+
+
+func PrintHashrate(hashrate float64) {
+	fmt.Printf("Mining at %.0f hashes/s\n", hashrate)
 }
 
 
@@ -403,43 +731,73 @@ func SendData(address string, data []byte) {
 
 	defer conn.Close()
 
-	_, err = io.Copy(conn, bytes.NewReader(data))
-	HandleError(err)
+	if _, err = io.Copy(conn, bytes.NewReader(data)); err != nil {
+		fmt.Printf("sending to %s failed: %s\n", address, err)
+	}
 }
 
 
 
 func HandleConnection(conn net.Conn, chain *blockchain.BlockChain) {
-	req, err := ioutil.ReadAll(conn)
-	HandleError(err)
 	defer conn.Close()
 
+	req, err := ioutil.ReadAll(io.LimitReader(conn, maxMessageSize+1))
+	if err != nil {
+		fmt.Println("reading request:", err)
+		return
+	}
+
+	if len(req) > maxMessageSize {
+		fmt.Printf("request is over the limit of %d bytes\n", maxMessageSize)
+		return
+	}
+
+	if len(req) < commandLength {
+		fmt.Println("request is too short")
+		return
+	}
+
 	command := BytesToCmd(req[:commandLength])
 	fmt.Printf("Received %s command\n", command)
 
+	if chain.Light && !lightCommand(command) {
+		fmt.Printf("%s is not served by a light node\n", command)
+		return
+	}
+
 	switch command {
 		case "address":
-			HandleAddress(req)
+			err = HandleAddress(req)
 		case "block":
-			HandleBlock(req, chain)
+			err = HandleBlock(req, chain)
 		case "inv":
-			HandleInv(req, chain)
+			err = HandleInv(req, chain)
 		case "getblocks":
-			HandleGetBlocks(req, chain)
+			err = HandleGetBlocks(req, chain)
 		case "getdata":
-			HandleGetData(req, chain)
+			err = HandleGetData(req, chain)
+		case "getheaders":
+			err = HandleGetHeaders(req, chain)
+		case "headers":
+			err = HandleHeaders(req, chain)
+		case "proofs":
+			err = HandleProofs(req, chain)
 		case "tx":
-			HandleTx(req, chain)
+			err = HandleTx(req, chain)
 		case "version":
-			HandleVersion(req, chain)
+			err = HandleVersion(req, chain)
 		default:
 			fmt.Println("Unknown command")
 	}
+
+	if err != nil {
+		fmt.Printf("%s: %s\n", command, err)
+	}
 }
 
 
 
-func StartServer(nodeID, mineraddress string) {
+func StartServer(nodeID, mineraddress string, engine blockchain.Engine) {
 	nodeAddress = fmt.Sprintf("localhost:%s", nodeID)
 	minerAddress = mineraddress
 
@@ -448,17 +806,21 @@ func StartServer(nodeID, mineraddress string) {
 
 	defer ln.Close()
 
-	chain := blockchain.ContinueBlockChain(nodeID)
-	defer chain.Database.Close()
+	chain, err := blockchain.ContinueBlockChain(nodeID, engine)
+	HandleError(err)
+	defer chain.Close()
 	go CloseDB(chain)
 
 	if nodeAddress != KnownNodes[0] {
-		SendVersion(KnownNodes[0], chain)
+		HandleError(SendVersion(KnownNodes[0], chain))
 	}
 
 	for {
 		conn, err := ln.Accept()
-		HandleError(err)
+		if err != nil {
+			fmt.Println(err)
+			continue
+		}
 		go HandleConnection(conn, chain)
 	}
 }
@@ -483,7 +845,7 @@ func CloseDB(chain *blockchain.BlockChain) {
 	d.WaitForDeathWithFunc(func(){
 		defer os.Exit(1)
 		defer runtime.Goexit()
-		chain.Database.Close()
+		chain.Close()
 	})
 }
 
@@ -0,0 +1,138 @@
+package storage
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/dgraph-io/badger"
+)
+
+type Badger struct {
+	DB							*badger.DB
+}
+
+type badgerTxn struct {
+	txn							*badger.Txn
+}
+
+
+// Exists reports whether a badger database was created in dir.
+func Exists(dir string) bool {
+	if _, err := os.Stat(dir+"/MANIFEST"); os.IsNotExist(err){
+		return false
+	}
+	return true
+}
+
+
+func OpenBadger(dir string) (*Badger, error) {
+	opts := badger.DefaultOptions(dir)
+	opts.Dir = dir
+	opts.ValueDir = dir
+
+	db, err := OpenDB(dir, opts)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Badger{db}, nil
+}
+
+
+func (store *Badger) View(fn func(txn Txn) error) error {
+	return store.DB.View(func(txn *badger.Txn) error {
+		return fn(badgerTxn{txn})
+	})
+}
+
+
+func (store *Badger) Update(fn func(txn Txn) error) error {
+	return store.DB.Update(func(txn *badger.Txn) error {
+		return fn(badgerTxn{txn})
+	})
+}
+
+
+func (store *Badger) Close() error {
+	return store.DB.Close()
+}
+
+
+func (t badgerTxn) Get(key []byte) ([]byte, error) {
+	item, err := t.txn.Get(key)
+	if errors.Is(err, badger.ErrKeyNotFound) {
+		return nil, ErrNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return item.ValueCopy(nil)
+}
+
+
+func (t badgerTxn) Put(key, value []byte) error {
+	return t.txn.Set(key, value)
+}
+
+
+func (t badgerTxn) Delete(key []byte) error {
+	return t.txn.Delete(key)
+}
+
+
+func (t badgerTxn) Iterate(prefix []byte, fn func(key, value []byte) error) error {
+	it := t.txn.NewIterator(badger.DefaultIteratorOptions)
+	defer it.Close()
+
+	for it.Seek(prefix); it.ValidForPrefix(prefix); it.Next() {
+		item := it.Item()
+		value, err := item.ValueCopy(nil)
+		if err != nil {
+			return err
+		}
+
+		if err := fn(item.KeyCopy(nil), value); err != nil {
+			if err == ErrStop {
+				return nil
+			}
+			return err
+		}
+	}
+
+	return nil
+}
+
+
+func Retry(dir string, originalOpts badger.Options) (*badger.DB, error) {
+	lockPath := filepath.Join(dir, "LOCK")
+	if err := os.Remove(lockPath); err != nil {
+		return nil, fmt.Errorf(`Removing "Lock" %s`, err)
+	}
+
+	retryOpts := originalOpts
+	retryOpts.Truncate = true
+	db, err := badger.Open(retryOpts)
+
+	return db, err
+}
+
+
+func OpenDB(dir string, opts badger.Options) (*badger.DB, error) {
+	if db, err := badger.Open(opts); err != nil {
+		if strings.Contains(err.Error(), "LOCK") {
+			if db, err := Retry(dir, opts); err == nil {
+				log.Println("Database unlocked, value log truncated")
+				return db, nil
+			}
+			log.Println("could not unlock database:", err)
+		}
+		return nil, err
+	}else {
+		return db, nil
+	}
+}
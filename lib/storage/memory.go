@@ -0,0 +1,147 @@
+package storage
+
+import (
+	"bytes"
+	"sort"
+	"sync"
+)
+
+// Memory keeps everything in a map, it is lost when the process exits.
+type Memory struct {
+	mutex						sync.RWMutex
+	data						map[string][]byte
+	closed						bool
+}
+
+type memoryTxn struct {
+	store						*Memory
+	// pending writes of an Update, a nil value is a delete
+	writes						map[string][]byte
+}
+
+
+func NewMemory() *Memory {
+	return &Memory{data: make(map[string][]byte)}
+}
+
+
+func (store *Memory) View(fn func(txn Txn) error) error {
+	store.mutex.RLock()
+	defer store.mutex.RUnlock()
+
+	if store.closed {
+		return ErrClosed
+	}
+
+	return fn(&memoryTxn{store, nil})
+}
+
+
+func (store *Memory) Update(fn func(txn Txn) error) error {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
+	if store.closed {
+		return ErrClosed
+	}
+
+	txn := &memoryTxn{store, make(map[string][]byte)}
+	if err := fn(txn); err != nil {
+		return err
+	}
+
+	for key, value := range txn.writes {
+		if value == nil {
+			delete(store.data, key)
+		}else {
+			store.data[key] = value
+		}
+	}
+
+	return nil
+}
+
+
+func (store *Memory) Close() error {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
+	store.closed = true
+	store.data = nil
+
+	return nil
+}
+
+
+func (t *memoryTxn) Get(key []byte) ([]byte, error) {
+	value, ok := t.store.data[string(key)]
+	if written, pending := t.writes[string(key)]; pending {
+		value, ok = written, written != nil
+	}
+
+	if !ok {
+		return nil, ErrNotFound
+	}
+
+	return append([]byte{}, value...), nil
+}
+
+
+func (t *memoryTxn) Put(key, value []byte) error {
+	if t.writes == nil {
+		return ErrReadOnly
+	}
+
+	t.writes[string(key)] = append([]byte{}, value...)
+
+	return nil
+}
+
+
+func (t *memoryTxn) Delete(key []byte) error {
+	if t.writes == nil {
+		return ErrReadOnly
+	}
+
+	t.writes[string(key)] = nil
+
+	return nil
+}
+
+
+func (t *memoryTxn) Iterate(prefix []byte, fn func(key, value []byte) error) error {
+	var keys []string
+
+	seen := make(map[string]bool)
+	collect := func(key string) {
+		if !seen[key] && bytes.HasPrefix([]byte(key), prefix) {
+			seen[key] = true
+			keys = append(keys, key)
+		}
+	}
+
+	for key := range t.store.data {
+		collect(key)
+	}
+	for key := range t.writes {
+		collect(key)
+	}
+
+	sort.Strings(keys)
+
+	for _, key := range keys {
+		value, err := t.Get([]byte(key))
+		if err == ErrNotFound {
+			continue
+		}
+
+		if err := fn([]byte(key), value); err != nil {
+			if err == ErrStop {
+				return nil
+			}
+			return err
+		}
+	}
+
+	return nil
+}
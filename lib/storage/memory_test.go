@@ -0,0 +1,160 @@
+package storage
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+)
+
+func get(t *testing.T, store Store, key string) ([]byte, error) {
+	t.Helper()
+
+	var value []byte
+	err := store.View(func(txn Txn) error {
+		var err error
+		value, err = txn.Get([]byte(key))
+		return err
+	})
+
+	return value, err
+}
+
+
+func TestMemoryUpdate(t *testing.T) {
+	store := NewMemory()
+
+	err := store.Update(func(txn Txn) error {
+		if err := txn.Put([]byte("a"), []byte("1")); err != nil {
+			return err
+		}
+		// writes are visible inside the transaction that made them
+		if value, err := txn.Get([]byte("a")); err != nil || !bytes.Equal(value, []byte("1")) {
+			t.Fatalf("read %q, %v inside the update", value, err)
+		}
+		if err := txn.Put([]byte("b"), []byte("2")); err != nil {
+			return err
+		}
+		return txn.Delete([]byte("b"))
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if value, err := get(t, store, "a"); err != nil || !bytes.Equal(value, []byte("1")) {
+		t.Fatalf("a is %q, %v, want 1", value, err)
+	}
+	if _, err := get(t, store, "b"); !errors.Is(err, ErrNotFound) {
+		t.Fatalf("deleted key gave %v, want ErrNotFound", err)
+	}
+}
+
+
+func TestMemoryRollback(t *testing.T) {
+	store := NewMemory()
+	failed := errors.New("failed")
+
+	err := store.Update(func(txn Txn) error {
+		if err := txn.Put([]byte("a"), []byte("1")); err != nil {
+			return err
+		}
+		return failed
+	})
+	if err != failed {
+		t.Fatalf("update gave %v, want the callback error", err)
+	}
+
+	if _, err := get(t, store, "a"); !errors.Is(err, ErrNotFound) {
+		t.Fatalf("write of a failed update is visible: %v", err)
+	}
+}
+
+
+func TestMemoryReadOnly(t *testing.T) {
+	store := NewMemory()
+
+	err := store.View(func(txn Txn) error {
+		if err := txn.Put([]byte("a"), []byte("1")); !errors.Is(err, ErrReadOnly) {
+			t.Fatalf("put in a view gave %v, want ErrReadOnly", err)
+		}
+		if err := txn.Delete([]byte("a")); !errors.Is(err, ErrReadOnly) {
+			t.Fatalf("delete in a view gave %v, want ErrReadOnly", err)
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+
+func TestMemoryValuesAreCopied(t *testing.T) {
+	store := NewMemory()
+	value := []byte("1")
+
+	store.Update(func(txn Txn) error {
+		return txn.Put([]byte("a"), value)
+	})
+	value[0] = '2'
+
+	read, _ := get(t, store, "a")
+	read[0] = '3'
+
+	if again, _ := get(t, store, "a"); !bytes.Equal(again, []byte("1")) {
+		t.Fatalf("stored value changed to %q", again)
+	}
+}
+
+
+func TestMemoryIterate(t *testing.T) {
+	store := NewMemory()
+
+	store.Update(func(txn Txn) error {
+		for _, key := range []string{"p-c", "p-a", "q-a", "p-b", "p-d"} {
+			if err := txn.Put([]byte(key), []byte(key)); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+
+	var keys []string
+	err := store.Update(func(txn Txn) error {
+		// pending writes and deletes are part of the iteration
+		txn.Delete([]byte("p-b"))
+		txn.Put([]byte("p-0"), nil)
+
+		return txn.Iterate([]byte("p-"), func(key, value []byte) error {
+			keys = append(keys, string(key))
+			if string(key) == "p-c" {
+				return ErrStop
+			}
+			return nil
+		})
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := []string{"p-0", "p-a", "p-c"}
+	if len(keys) != len(want) {
+		t.Fatalf("iterated %q, want %q", keys, want)
+	}
+	for i := range want {
+		if keys[i] != want[i] {
+			t.Fatalf("iterated %q, want %q", keys, want)
+		}
+	}
+}
+
+
+func TestMemoryClosed(t *testing.T) {
+	store := NewMemory()
+	store.Close()
+
+	if err := store.View(func(txn Txn) error { return nil }); !errors.Is(err, ErrClosed) {
+		t.Fatalf("view of a closed store gave %v, want ErrClosed", err)
+	}
+	if err := store.Update(func(txn Txn) error { return nil }); !errors.Is(err, ErrClosed) {
+		t.Fatalf("update of a closed store gave %v, want ErrClosed", err)
+	}
+}
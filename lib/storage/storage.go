@@ -0,0 +1,30 @@
+package storage
+
+import "errors"
+
+var (
+	ErrNotFound = errors.New("key not found")
+	ErrReadOnly = errors.New("write in a read-only transaction")
+	ErrClosed = errors.New("store is closed")
+	// ErrStop can be returned from an Iterate callback to end the iteration
+	// early without Iterate returning an error.
+	ErrStop = errors.New("stop iteration")
+)
+
+// Txn is a view of the store inside View or Update. Writes made in an
+// Update are visible to later reads of the same transaction and are applied
+// together when the callback returns nil.
+type Txn interface {
+	Get(key []byte) ([]byte, error)
+	Put(key, value []byte) error
+	Delete(key []byte) error
+	// Iterate calls fn for every key starting with prefix in ascending order.
+	Iterate(prefix []byte, fn func(key, value []byte) error) error
+}
+
+// Store is a key value store the chain keeps its data in.
+type Store interface {
+	View(fn func(txn Txn) error) error
+	Update(fn func(txn Txn) error) error
+	Close() error
+}
@@ -11,6 +11,7 @@ import (
 
 	// "tensor/lib/blockchain"
 
+	"github.com/mr-tron/base58"
 	"golang.org/x/crypto/ripemd160"
 )
 
@@ -33,7 +34,8 @@ func NewKeyPair() (ecdsa.PrivateKey, []byte){
 	private, err := ecdsa.GenerateKey(curve, rand.Reader)
 	HandleError(err)
 
-	pub := append(private.PublicKey.X.Bytes(), private.PublicKey.Y.Bytes()...)
+	// fixed width halves so the key splits back into X and Y unambiguously
+	pub := append(private.PublicKey.X.FillBytes(make([]byte, 32)), private.PublicKey.Y.FillBytes(make([]byte, 32))...)
 
 	return *private, pub
 }
@@ -88,7 +90,11 @@ func (wallet *Wallet) Address() []byte {
 
 
 func ValidateAddress(address string) bool {
-	PubKeyHash := Base58Decode([]byte(address))
+	// Base58Decode panics on bad input, an address may come from anyone
+	PubKeyHash, err := base58.Decode(address)
+	if err != nil || len(PubKeyHash) <= 1+checksumLength {
+		return false
+	}
 	actualChecksum := PubKeyHash[len(PubKeyHash)-checksumLength:]
 	version := PubKeyHash[0]
 	PubKeyHash = PubKeyHash[1: len(PubKeyHash)-checksumLength]
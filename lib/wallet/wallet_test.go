@@ -0,0 +1,26 @@
+package wallet
+
+import "testing"
+
+func TestKeyWidth(t *testing.T) {
+	// X or Y is shorter than 32 bytes about once in 128 keys
+	for i := 0; i < 2000; i++ {
+		if w := MakeWallet(); len(w.PublicKey) != 64 {
+			t.Fatalf("public key has %d bytes", len(w.PublicKey))
+		}
+	}
+}
+
+
+func TestValidateAddress(t *testing.T) {
+	w := MakeWallet()
+	if address := string(w.Address()); !ValidateAddress(address) {
+		t.Fatalf("address %s of a new wallet is not valid", address)
+	}
+
+	for _, address := range []string{"", "0OIl", "1111111111111111111111111111111111"} {
+		if ValidateAddress(address) {
+			t.Fatalf("address %q is valid", address)
+		}
+	}
+}